@@ -0,0 +1,301 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"repo/log"
+	"strings"
+)
+
+// ArchiveResponseInfo is the response of an upload which is extracted.
+type ArchiveResponseInfo struct {
+	ErrInfo
+	Files   map[string]*FileInfo // every extracted path
+	Skipped []string             `json:",omitempty"` // exist already and replaceIfExist is false
+	Failed  string               `json:",omitempty"` // the path which could not be stored, the ones in Files are
+}
+
+// stagedEntry is an archive entry which has been extracted into a staging file.
+type stagedEntry struct {
+	reqPath   string
+	name      string // name of the entry in the archive
+	stagePath string
+	digests   digester
+}
+
+// extractLimiter applies the decoding limits to the total extracted size of an archive.
+type extractLimiter struct {
+	r       io.Reader
+	total   *int64
+	archive func() int64 // bytes of the archive read so far
+}
+
+func (l *extractLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	*l.total += int64(n)
+	if limitErr := checkDecodeLimits(*l.total, l.archive()); limitErr != nil {
+		return n, limitErr
+	}
+	return n, err
+}
+
+// archiveFormat returns tar, tgz or zip for the extract option, auto detects it from the magic bytes.
+func archiveFormat(extract string, br *bufio.Reader) string {
+	switch strings.ToLower(extract) {
+	case "tar":
+		return "tar"
+	case "tgz", "tar.gz":
+		return "tgz"
+	case "zip":
+		return "zip"
+	case "auto", "true", "1":
+		magic, _ := br.Peek(512)
+		switch {
+		case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+			return "zip"
+		case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+			return "tgz"
+		case len(magic) >= 262 && string(magic[257:262]) == "ustar":
+			return "tar"
+		}
+	}
+	return ""
+}
+
+// archiveEntryPath returns the request path of an archive entry under prefix. Absolute names,
+// names which climb out of prefix with ".." and paths rejected by confinePath are rejected.
+func archiveEntryPath(prefix, name string) (string, error) {
+	name = strings.Replace(name, "\\", "/", -1)
+	if name == "" || name[0] == '/' || strings.IndexByte(name, 0) >= 0 || (len(name) > 1 && name[1] == ':') {
+		return "", fmt.Errorf("invalid archive entry: %q", name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("archive entry escapes dest: %q", name)
+		}
+	}
+	prefix = path.Clean(prefix)
+	reqPath := path.Join(prefix, name)
+	if !strings.HasPrefix(reqPath, strings.TrimSuffix(prefix, "/")+"/") {
+		return "", fmt.Errorf("archive entry escapes dest: %q", name)
+	}
+	return confineFilePath(reqPath)
+}
+
+// archiveErrCode maps an error of extracting an archive to the ErrCode of the response.
+func archiveErrCode(err error, raw *countingReader) ErrCode {
+	if raw.err != nil {
+		return contentErrCode(raw.err)
+	}
+	if errCode := contentErrCode(err); errCode != ERR_HTTP_GET_CONTENT {
+		return errCode
+	}
+	return ERR_CORRUPT_CONTENT
+}
+
+/*
+Upload a tar, tar.gz or zip archive and extract it under dest, set extract to tar, tgz, zip or auto
+curl -F "file=@site.tar.gz" -F dest=/docs/v1.2 -F extract=auto -F expiredTime=240h "http://localhost:50010/r/upload/"
+curl -T site.zip "http://localhost:50010/r/upload/docs/v1.2?extract=zip"
+Return value:
+{"Status":0,"Msg":"OK","Files":{"/docs/v1.2/index.html":{"CreateTime":"...","Md5":"...","ExpiredTime":"...","DownloadPath":"..."}}}
+Nothing is stored if an entry is not a regular file, its name escapes dest, its path is a directory or one of its parents is a file,
+or if the archive has more than maxArchiveEntries entries or extracts to more than the decoding limits allow.
+If storing an entry fails, the response has its error, the entries stored before it in Files and it in Failed.
+*/
+func saveArchive(w http.ResponseWriter, r *http.Request, prefix string, content io.Reader, opts uploadOptions) {
+	br := bufio.NewReader(content)
+	format := archiveFormat(opts.extract, br)
+	if format == "" {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_ARCHIVE_FORMAT))
+		return
+	}
+	raw := &countingReader{r: br}
+	var total int64
+	entries := 0
+	// counts an entry of the archive, directories too, and reports whether it is one too many
+	tooMany := func() bool {
+		entries++
+		if svr.maxArchiveEntries > 0 && entries > svr.maxArchiveEntries {
+			log.Warnf("extract %s: more than %d entries", prefix, svr.maxArchiveEntries)
+			return true
+		}
+		return false
+	}
+	staged := make([]*stagedEntry, 0)
+	defer func() {
+		for _, e := range staged {
+			os.Remove(e.stagePath) // fails harmlessly once published
+		}
+	}()
+	stage := func(name string, entry io.Reader, archiveSize func() int64) ErrCode {
+		reqPath, err := archiveEntryPath(prefix, name)
+		if err != nil {
+			log.Warn(err)
+			return ERR_ARCHIVE_ENTRY
+		}
+		stagePath, digests, err := stageContent(&extractLimiter{r: entry, total: &total, archive: archiveSize}, nil)
+		if err != nil {
+			log.Warnf("%s: %v", reqPath, err)
+			return archiveErrCode(err, raw)
+		}
+		staged = append(staged, &stagedEntry{reqPath: reqPath, name: name, stagePath: stagePath, digests: digests})
+		return ERR_OK
+	}
+	rawSize := func() int64 { return raw.n }
+
+	switch format {
+	case "tar", "tgz":
+		var tarContent io.Reader = raw
+		if format == "tgz" {
+			gr, err := gzip.NewReader(raw)
+			if err != nil {
+				log.Warn(err)
+				json.NewEncoder(w).Encode(MakeErrInfo(archiveErrCode(err, raw)))
+				return
+			}
+			defer gr.Close()
+			tarContent = gr
+		}
+		tr := tar.NewReader(tarContent)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Warn(err)
+				json.NewEncoder(w).Encode(MakeErrInfo(archiveErrCode(err, raw)))
+				return
+			}
+			if tooMany() {
+				json.NewEncoder(w).Encode(MakeErrInfo(ERR_ARCHIVE_ENTRIES))
+				return
+			}
+			switch hdr.Typeflag {
+			case tar.TypeDir, tar.TypeXGlobalHeader:
+				continue
+			case tar.TypeReg:
+				if errCode := stage(hdr.Name, tr, rawSize); errCode != ERR_OK {
+					json.NewEncoder(w).Encode(MakeErrInfo(errCode))
+					return
+				}
+			default:
+				log.Warnf("archive entry %q is not a regular file", hdr.Name)
+				json.NewEncoder(w).Encode(MakeErrInfo(ERR_ARCHIVE_ENTRY))
+				return
+			}
+		}
+	case "zip":
+		// zip keeps its directory at the end, so the archive is spooled to disk first
+		f, err := createStageFile()
+		if err != nil {
+			log.Error(err)
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_OPEN_FILE))
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		size, err := io.Copy(f, raw)
+		if err != nil {
+			log.Warn(err)
+			json.NewEncoder(w).Encode(MakeErrInfo(archiveErrCode(err, raw)))
+			return
+		}
+		zr, err := zip.NewReader(f, size)
+		if err != nil {
+			log.Warn(err)
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_CORRUPT_CONTENT))
+			return
+		}
+		for _, zf := range zr.File {
+			if tooMany() {
+				json.NewEncoder(w).Encode(MakeErrInfo(ERR_ARCHIVE_ENTRIES))
+				return
+			}
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			if !zf.Mode().IsRegular() {
+				log.Warnf("archive entry %q is not a regular file", zf.Name)
+				json.NewEncoder(w).Encode(MakeErrInfo(ERR_ARCHIVE_ENTRY))
+				return
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				log.Warn(err)
+				json.NewEncoder(w).Encode(MakeErrInfo(ERR_CORRUPT_CONTENT))
+				return
+			}
+			errCode := stage(zf.Name, rc, func() int64 { return size })
+			rc.Close()
+			if errCode != ERR_OK {
+				json.NewEncoder(w).Encode(MakeErrInfo(errCode))
+				return
+			}
+		}
+	}
+
+	if opts.contentMD5 != nil && !opts.contentMD5() {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_CHECKSUM_MISMATCH))
+		return
+	}
+	response := ArchiveResponseInfo{ErrInfo: MakeErrInfo(ERR_OK), Files: make(map[string]*FileInfo)}
+	replace := strings.ToLower(opts.replaceIfExist) == "true" || opts.replaceIfExist == "1"
+	// every entry is checked before the first one is published, so a conflict stores nothing
+	publish := make([]*stagedEntry, 0, len(staged))
+	entryPaths := make(map[string]bool, len(staged))
+	for _, e := range staged {
+		entryPaths[e.reqPath] = true
+	}
+	for _, e := range staged {
+		// the parents of the entry must be directories, not files on disk or in the archive
+		for dir := path.Dir(e.reqPath); dir != "/"; dir = path.Dir(dir) {
+			if st, err := os.Stat(path.Join(svr.dataDir, dir)); entryPaths[dir] || err == nil && !st.IsDir() {
+				log.Warnf("%s: %s is a file", e.reqPath, dir)
+				json.NewEncoder(w).Encode(MakeErrInfo(ERR_MKDIR))
+				return
+			}
+		}
+		if st, err := os.Stat(path.Join(svr.dataDir, e.reqPath)); err == nil {
+			if st.IsDir() {
+				log.Warnf("%s exists as a directory", e.reqPath)
+				json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_EXIST_DIR))
+				return
+			}
+			if !replace {
+				response.Skipped = append(response.Skipped, e.reqPath)
+				continue
+			}
+		}
+		publish = append(publish, e)
+	}
+	for _, e := range publish {
+		entryOpts := opts
+		entryOpts.contentType = "" // the declared type is the one of the archive
+		entryOpts.fileName = cleanFileName(e.name)
+		fileInfo, err := newFileInfo(e.reqPath, e.stagePath, e.digests, entryOpts)
+		if err != nil {
+			log.Error(err)
+			response.ErrInfo, response.Failed = MakeErrInfo(ERR_OPEN_FILE), e.reqPath
+			break
+		}
+		if errCode := publishFile(e.stagePath, e.reqPath, fileInfo); errCode != ERR_OK {
+			response.ErrInfo, response.Failed = MakeErrInfo(errCode), e.reqPath
+			break
+		}
+		fileInfo.DownloadPath = downloadPath(r, e.reqPath, nil)
+		response.Files[e.reqPath] = fileInfo
+	}
+	log.Debugf("extract %s: %d files, %d skipped", prefix, len(response.Files), len(response.Skipped))
+	json.NewEncoder(w).Encode(response)
+}
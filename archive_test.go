@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestArchiveEntryPath(t *testing.T) {
+	defer func(dataDir string) { svr.dataDir = dataDir }(svr.dataDir)
+	svr.dataDir = t.TempDir()
+	tests := []struct {
+		prefix string
+		name   string
+		want   string // "" if the entry is rejected
+	}{
+		{"/docs", "index.html", "/docs/index.html"},
+		{"/docs/", "css/site.css", "/docs/css/site.css"},
+		{"/docs", "./a/./b.txt", "/docs/a/b.txt"},
+		{"/docs", `win\style\path.txt`, "/docs/win/style/path.txt"},
+		{"/docs", "a//b.txt", "/docs/a/b.txt"},
+		// zip-slip
+		{"/docs", "../evil.txt", ""},
+		{"/docs", "a/../../evil.txt", ""},
+		{"/docs", "a/../b.txt", ""},
+		{"/docs", `..\evil.txt`, ""},
+		{"/docs", "/etc/passwd", ""},
+		{"/docs", `\etc\passwd`, ""},
+		{"/docs", "C:/evil.txt", ""},
+		{"/docs", "c:evil.txt", ""},
+		{"/docs", "evil\x00.txt", ""},
+		{"/docs", "", ""},
+		{"/docs", ".", ""},
+		{"/docs", "a/", "/docs/a"},
+		// into the reserved directories of dataDir
+		{"/", ".blobs/ab/abcdef", ""},
+		{"/", ".tmp/stage-1", ""},
+		{"/", ".versions/a.txt", ""},
+		{"/", ".gzip/ab/abcdef.gz", ""},
+		{"/docs", ".blobs/a", "/docs/.blobs/a"},
+		{"/docs", "line\nbreak.txt", ""},
+	}
+	for _, tt := range tests {
+		got, err := archiveEntryPath(tt.prefix, tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("archiveEntryPath(%q, %q) = %q, want an error", tt.prefix, tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("archiveEntryPath(%q, %q) = %q, %v, want %q", tt.prefix, tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestArchiveFormat(t *testing.T) {
+	ustar := make([]byte, 512)
+	copy(ustar[257:], "ustar")
+	tests := []struct {
+		extract string
+		content string
+		want    string
+	}{
+		{"tar", "", "tar"},
+		{"TGZ", "", "tgz"},
+		{"tar.gz", "", "tgz"},
+		{"zip", "", "zip"},
+		{"auto", "PK\x03\x04rest", "zip"},
+		{"auto", "PK\x05\x06", "zip"},
+		{"true", "\x1f\x8b\x08", "tgz"},
+		{"1", string(ustar), "tar"},
+		{"auto", "plain text", ""},
+		{"rar", "PK\x03\x04", ""},
+		{"", "PK\x03\x04", ""},
+	}
+	for _, tt := range tests {
+		if got := archiveFormat(tt.extract, bufio.NewReader(strings.NewReader(tt.content))); got != tt.want {
+			t.Errorf("archiveFormat(%q, %q) = %q, want %q", tt.extract, tt.content, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"repo/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Right is what a token may do under the prefix of a scope, a right includes the lower ones.
+type Right int
+
+const (
+	RIGHT_READ Right = iota + 1
+	RIGHT_WRITE
+	RIGHT_ADMIN
+)
+
+var rightNames = map[string]Right{
+	"read":  RIGHT_READ,
+	"write": RIGHT_WRITE,
+	"admin": RIGHT_ADMIN,
+}
+
+// Token is an API token, it is saved in the tokens bucket keyed by the sha256 of its secret,
+// the secret itself is only returned when the token is created.
+type Token struct {
+	ID         string
+	Name       string
+	Scopes     []string // right:prefix, like write:/release
+	CreateTime time.Time
+	// the token of a signed URL is only valid on the prefixes of its scopes themselves, not below them
+	exact bool
+}
+
+// TokenResponseInfo is the response of the token endpoints.
+type TokenResponseInfo struct {
+	ErrInfo
+	Token  *Token   `json:",omitempty"`
+	Secret string   `json:",omitempty"` // only when the token is created
+	Tokens []*Token `json:",omitempty"`
+}
+
+// fileTokens are the tokens of -tokenFile, keyed by the sha256 of their secrets.
+var fileTokens = struct {
+	sync.RWMutex
+	m map[string]*Token
+}{m: make(map[string]*Token)}
+
+type tokenKey struct{}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScope parses right:prefix.
+func parseScope(scope string) (Right, string, error) {
+	kv := strings.SplitN(scope, ":", 2)
+	if len(kv) != 2 {
+		return 0, "", fmt.Errorf("invalid scope: %s", scope)
+	}
+	right, ok := rightNames[strings.ToLower(kv[0])]
+	if !ok {
+		return 0, "", fmt.Errorf("invalid right of scope: %s", scope)
+	}
+	if kv[1] == "" || kv[1][0] != '/' {
+		return 0, "", fmt.Errorf("invalid prefix of scope: %s", scope)
+	}
+	return right, path.Clean(kv[1]), nil
+}
+
+// allows reports whether t has right on reqPath, an empty reqPath asks for right on any prefix.
+// An exact token has rights only on the prefixes themselves.
+func (t *Token) allows(reqPath string, right Right) bool {
+	for _, scope := range t.Scopes {
+		r, prefix, err := parseScope(scope)
+		if err != nil || r < right {
+			continue
+		}
+		if reqPath == "" || reqPath == prefix {
+			return true
+		}
+		if !t.exact && (prefix == "/" || strings.HasPrefix(reqPath, prefix+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTokenFile loads a JSON array of tokens, like [{"Name":"ci","Secret":"...","Scopes":["write:/release"]}].
+func loadTokenFile(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var entries []struct {
+		Token
+		Secret string
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	tokens := make(map[string]*Token, len(entries))
+	for i := range entries {
+		e := &entries[i]
+		if len(e.Secret) < 16 {
+			return fmt.Errorf("%s: secret of token %q is shorter than 16 characters", file, e.Name)
+		}
+		for _, scope := range e.Scopes {
+			if _, _, err := parseScope(scope); err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+		}
+		hash := hashToken(e.Secret)
+		if e.ID == "" {
+			e.ID = "file-" + hash[:12]
+		}
+		tokens[hash] = &e.Token
+	}
+	fileTokens.Lock()
+	fileTokens.m = tokens
+	fileTokens.Unlock()
+	log.Infof("loaded %d tokens from %s", len(tokens), file)
+	return nil
+}
+
+// lookupToken returns the token of secret from -tokenFile or the tokens bucket, nil if there is none.
+func lookupToken(secret string) (*Token, error) {
+	hash := hashToken(secret)
+	fileTokens.RLock()
+	token := fileTokens.m[hash]
+	fileTokens.RUnlock()
+	if token != nil {
+		return token, nil
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tokens"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		v := b.Get([]byte(hash))
+		if v == nil {
+			return nil
+		}
+		token = &Token{}
+		return json.Unmarshal(v, token)
+	})
+	return token, err
+}
+
+// requestSecret returns the token sent with "Authorization: Bearer <token>" or X-Auth-Token.
+func requestSecret(r *http.Request) string {
+	if v := r.Header.Get("Authorization"); len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+		return strings.TrimSpace(v[7:])
+	}
+	return r.Header.Get("X-Auth-Token")
+}
+
+func writeAuthError(w http.ResponseWriter, status int, errCode ErrCode) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="repo"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(MakeErrInfo(errCode))
+}
+
+// authorized checks the token of the request before h runs, it needs right on the filepath parameter.
+func authorized(right Right, h httprouter.Handle) httprouter.Handle {
+	return authorizedPath(right, func(ps httprouter.Params) string { return ps.ByName("filepath") }, h)
+}
+
+// authenticated checks the token of the request before h runs, it needs right on any prefix,
+// for the handlers which read their paths from the request and check them with checkRight.
+func authenticated(right Right, h httprouter.Handle) httprouter.Handle {
+	return authorizedPath(right, func(httprouter.Params) string { return "" }, h)
+}
+
+// adminOnly is authorized for the endpoints of the whole server, they need admin right on "/".
+func adminOnly(h httprouter.Handle) httprouter.Handle {
+	return authorizedPath(RIGHT_ADMIN, func(httprouter.Params) string { return "/" }, h)
+}
+
+// authorizedPath checks a signed URL even when -auth is off, a valid one stands for a token of its path.
+func authorizedPath(right Right, pathOf func(httprouter.Params) string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if isSigned(r) {
+			token, err := verifySignature(r, pathOf(ps))
+			if err != nil {
+				log.Warnf("%s: %s, From: %s, %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+				writeAuthError(w, http.StatusForbidden, ERR_SIGNATURE)
+				return
+			}
+			if !token.allows(pathOf(ps), right) {
+				writeAuthError(w, http.StatusForbidden, ERR_FORBIDDEN)
+				return
+			}
+			if !limitSignedBody(w, r) {
+				return
+			}
+			h(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)), ps)
+			return
+		}
+		if !svr.auth {
+			h(w, r, ps)
+			return
+		}
+		// a token in the request goes before the client certificate
+		token := certToken(r)
+		if secret := requestSecret(r); secret != "" {
+			var err error
+			if token, err = lookupToken(secret); err != nil {
+				log.Error(err)
+				writeAuthError(w, http.StatusInternalServerError, ERR_READ_DB)
+				return
+			}
+		}
+		if token == nil {
+			log.Warnf("%s: %s, From: %s, no valid token or client certificate", r.Method, r.URL.Path, r.RemoteAddr)
+			writeAuthError(w, http.StatusUnauthorized, ERR_UNAUTHORIZED)
+			return
+		}
+		if !token.allows(pathOf(ps), right) {
+			log.Warnf("%s: %s, From: %s, token %s is not allowed", r.Method, r.URL.Path, r.RemoteAddr, token.ID)
+			writeAuthError(w, http.StatusForbidden, ERR_FORBIDDEN)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)), ps)
+	}
+}
+
+// checkAdminToken makes sure that -auth leaves a way to manage tokens: an admin token of "/"
+// in -tokenFile, in the tokens bucket or of a client certificate of -clientCertFile.
+func checkAdminToken() error {
+	isAdmin := func(token *Token) bool { return token.allows("/", RIGHT_ADMIN) }
+	fileTokens.RLock()
+	defer fileTokens.RUnlock()
+	for _, token := range fileTokens.m {
+		if isAdmin(token) {
+			return nil
+		}
+	}
+	serverTLS.RLock()
+	defer serverTLS.RUnlock()
+	for _, token := range serverTLS.subjects {
+		if isAdmin(token) {
+			return nil
+		}
+	}
+	found := false
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tokens"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		return b.ForEach(func(k, v []byte) error {
+			token := &Token{}
+			if err := json.Unmarshal(v, token); err == nil && isAdmin(token) {
+				found = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf(`-auth needs an admin token of "/" in -tokenFile, like [{"Name":"admin","Secret":"...","Scopes":["admin:/"]}]`)
+	}
+	return nil
+}
+
+// checkRight checks a path which a handler reads from its request, it writes the 403 response and
+// returns false if the token of r, or the signed URL of r, lacks right on reqPath.
+func checkRight(w http.ResponseWriter, r *http.Request, reqPath string, right Right) bool {
+	token, _ := r.Context().Value(tokenKey{}).(*Token)
+	if token == nil && !svr.auth || token != nil && token.allows(reqPath, right) {
+		return true
+	}
+	log.Warnf("%s: %s, From: %s, not allowed on %s", r.Method, r.URL.Path, r.RemoteAddr, reqPath)
+	writeAuthError(w, http.StatusForbidden, ERR_FORBIDDEN)
+	return false
+}
+
+/*
+Create an API token, only an admin token of "/" can manage tokens
+curl -H "Authorization: Bearer $ADMIN_TOKEN" -F name=ci -F scope=write:/release -F scope=read:/ "http://localhost:50010/r/tokens"
+Return value, the secret is not shown again:
+{"Status":0,"Msg":"OK","Token":{"ID":"3f2a...","Name":"ci","Scopes":["write:/release","read:/"],"CreateTime":"..."},"Secret":"9c1e..."}
+A right includes the lower ones: read < write < admin
+With -auth the first admin token comes from -tokenFile, or a client certificate of -clientCertFile, the server
+does not start without an admin token of "/" there or in the db, like -tokenFile admin.json with:
+[{"Name":"admin","Secret":"at least 16 characters","Scopes":["admin:/"]}]
+*/
+func createToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	r.ParseMultipartForm(32 << 20)
+	scopes := r.Form["scope"]
+	if len(scopes) == 0 {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_SCOPE))
+		return
+	}
+	for i, scope := range scopes {
+		right, prefix, err := parseScope(scope)
+		if err != nil {
+			log.Warn(err)
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_SCOPE))
+			return
+		}
+		for name, rt := range rightNames {
+			if rt == right {
+				scopes[i] = name + ":" + prefix
+			}
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_UPDATE_DB))
+		return
+	}
+	secret := hex.EncodeToString(b)
+	hash := hashToken(secret)
+	token := &Token{
+		ID:         hash[:12],
+		Name:       valuesGetDefault(r.Form, "name", ""),
+		Scopes:     scopes,
+		CreateTime: time.Now(),
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tokens"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		encoded, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(hash), encoded)
+	})
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_UPDATE_DB))
+		return
+	}
+	log.Infof("create token %s (%s): %v", token.ID, token.Name, token.Scopes)
+	json.NewEncoder(w).Encode(TokenResponseInfo{ErrInfo: MakeErrInfo(ERR_OK), Token: token, Secret: secret})
+}
+
+/*
+List the API tokens, the ones of -tokenFile included
+curl -H "Authorization: Bearer $ADMIN_TOKEN" "http://localhost:50010/r/tokens"
+*/
+func listTokens(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	tokens := make([]*Token, 0)
+	fileTokens.RLock()
+	for _, token := range fileTokens.m {
+		tokens = append(tokens, token)
+	}
+	fileTokens.RUnlock()
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tokens"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		return b.ForEach(func(k, v []byte) error {
+			token := &Token{}
+			if err := json.Unmarshal(v, token); err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	json.NewEncoder(w).Encode(TokenResponseInfo{ErrInfo: MakeErrInfo(ERR_OK), Tokens: tokens})
+}
+
+/*
+Revoke an API token by its ID, the tokens of -tokenFile are revoked by editing the file
+curl -X DELETE -H "Authorization: Bearer $ADMIN_TOKEN" "http://localhost:50010/r/tokens/3f2a..."
+*/
+func deleteToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	id := ps.ByName("id")
+	var deleted *Token
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tokens"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		// the ID is the beginning of the key
+		c := b.Cursor()
+		k, v := c.Seek([]byte(id))
+		if k == nil || id == "" || !strings.HasPrefix(string(k), id) {
+			return nil
+		}
+		deleted = &Token{}
+		if err := json.Unmarshal(v, deleted); err != nil {
+			return err
+		}
+		if deleted.ID != id {
+			deleted = nil
+			return nil
+		}
+		return b.Delete(k)
+	})
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_UPDATE_DB))
+		return
+	}
+	if deleted == nil {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_TOKEN_NOT_EXIST))
+		return
+	}
+	log.Infof("delete token %s (%s)", deleted.ID, deleted.Name)
+	json.NewEncoder(w).Encode(TokenResponseInfo{ErrInfo: MakeErrInfo(ERR_OK), Token: deleted})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"os"
+	"path"
+	"repo/log"
+	"sync"
+)
+
+// BLOB_DIR is the directory under dataDir which holds deduplicated content, keyed by sha256.
+// A stored path is a hard link to its blob, so it is read like any other file.
+const BLOB_DIR = ".blobs"
+
+// Blob is the record of a deduplicated content in the blobs bucket.
+type Blob struct {
+	Size     int64
+	RefCount int
+}
+
+// blobMu serializes the changes of blob reference counts with the links on disk.
+var blobMu sync.Mutex
+
+func blobPath(sum string) string {
+	return path.Join(svr.dataDir, BLOB_DIR, sum[:2], sum)
+}
+
+// stageBlob links the staged content into the blob store, unless the blob is already there,
+// and then replaces stagePath with a hard link to the blob. created is true if the blob file is new.
+// On error stagePath keeps the staged content, so the file can still be stored without dedup.
+func stageBlob(stagePath, sum string) (size int64, created bool, err error) {
+	bp := blobPath(sum)
+	st, err := os.Stat(bp)
+	if err == nil {
+		// a moved file, or a copy staged from the blob, is a link to the blob already, and renaming
+		// a link over another one of the same file does nothing
+		if staged, err := os.Stat(stagePath); err != nil {
+			return 0, false, err
+		} else if os.SameFile(staged, st) {
+			return st.Size(), false, nil
+		}
+		// the link is made aside and renamed over the staged content once it is there
+		tmp := stagePath + ".blob"
+		if err := os.Link(bp, tmp); err != nil {
+			return 0, false, err
+		}
+		if err := os.Rename(tmp, stagePath); err != nil {
+			os.Remove(tmp)
+			return 0, false, err
+		}
+		return st.Size(), false, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, false, err
+	}
+	if err := os.MkdirAll(path.Dir(bp), os.ModePerm); err != nil {
+		return 0, false, err
+	}
+	if err := os.Link(stagePath, bp); err != nil {
+		return 0, false, err
+	}
+	if st, err = os.Stat(bp); err != nil {
+		return 0, false, err
+	}
+	return st.Size(), true, nil
+}
+
+// retainBlob adds a reference to blob sum.
+func retainBlob(tx *bolt.Tx, sum string, size int64) error {
+	b := tx.Bucket([]byte("blobs"))
+	if b == nil {
+		return fmt.Errorf("read db error")
+	}
+	blob := &Blob{Size: size}
+	if v := b.Get([]byte(sum)); v != nil {
+		if err := json.Unmarshal(v, blob); err != nil {
+			return err
+		}
+	}
+	blob.RefCount++
+	encoded, err := json.Marshal(blob)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(sum), encoded)
+}
+
+// releaseBlob drops a reference to blob sum, the record is deleted with the last reference,
+// and then the caller should remove the blob file once tx is committed.
+func releaseBlob(tx *bolt.Tx, sum string) (last bool, err error) {
+	b := tx.Bucket([]byte("blobs"))
+	if b == nil {
+		return false, fmt.Errorf("read db error")
+	}
+	v := b.Get([]byte(sum))
+	if v == nil {
+		log.Warnf("blob %s has no record", sum)
+		return true, nil
+	}
+	blob := &Blob{}
+	if err := json.Unmarshal(v, blob); err != nil {
+		return false, err
+	}
+	blob.RefCount--
+	if blob.RefCount <= 0 {
+		return true, b.Delete([]byte(sum))
+	}
+	encoded, err := json.Marshal(blob)
+	if err != nil {
+		return false, err
+	}
+	return false, b.Put([]byte(sum), encoded)
+}
+
+func removeBlobFile(sum string) {
+	bp := blobPath(sum)
+	log.Debugf("remove blob: %s", bp)
+	if err := os.Remove(bp); err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+	}
+	// the fan-out directory is left alone when it still has other blobs
+	os.Remove(path.Dir(bp))
+}
+
+// dedupStats returns the number of blobs and the bytes saved by sharing them.
+func dedupStats() (blobs int, savedBytes int64) {
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("blobs"))
+		if b == nil {
+			log.Error("DB bucket blobs does not exist ")
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			blob := &Blob{}
+			if err := json.Unmarshal(v, blob); err != nil {
+				log.Error(err)
+				continue
+			}
+			blobs++
+			if blob.RefCount > 1 {
+				savedBytes += int64(blob.RefCount-1) * blob.Size
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// dbSnapshot keeps the previous values of the keys changed in a transaction, so they can be put back.
+type dbSnapshot map[string]map[string][]byte
+
+// save records the current value of key in bucket, a nil value means it didn't exist.
+func (s dbSnapshot) save(tx *bolt.Tx, bucket, key string) {
+	if _, ok := s[bucket]; !ok {
+		s[bucket] = make(map[string][]byte)
+	}
+	if _, ok := s[bucket][key]; ok {
+		return
+	}
+	var old []byte
+	if b := tx.Bucket([]byte(bucket)); b != nil {
+		if v := b.Get([]byte(key)); v != nil {
+			old = append([]byte(nil), v...)
+		}
+	}
+	s[bucket][key] = old
+}
+
+func (s dbSnapshot) restore(tx *bolt.Tx) error {
+	for bucket, values := range s {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		for k, v := range values {
+			var err error
+			if v == nil {
+				err = b.Delete([]byte(k))
+			} else {
+				err = b.Put([]byte(k), v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
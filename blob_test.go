@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// blobRefs reads the reference counts of the blobs bucket by sum.
+func blobRefs(t *testing.T) map[string]int {
+	t.Helper()
+	refs := make(map[string]int)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("blobs")).ForEach(func(k, v []byte) error {
+			blob := &Blob{}
+			if err := json.Unmarshal(v, blob); err != nil {
+				return err
+			}
+			refs[string(k)] = blob.RefCount
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return refs
+}
+
+// dataFiles lists the files under dataDir by their path relative to it, the ones of BLOB_DIR by sum.
+func dataFiles(t *testing.T) (files []string, blobs []string) {
+	t.Helper()
+	err := filepath.Walk(svr.dataDir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(svr.dataDir, name)
+		if err != nil {
+			return err
+		}
+		if filepath.Dir(filepath.Dir(rel)) == BLOB_DIR {
+			blobs = append(blobs, fi.Name())
+		} else {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	sort.Strings(blobs)
+	return files, blobs
+}
+
+func sha256Hex(content string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+}
+
+func TestBlobRefCounts(t *testing.T) {
+	testServer(t)
+	svr.dedup = true
+	x, y, z, w := sha256Hex("x content"), sha256Hex("y content"), sha256Hex("z content"), sha256Hex("w content")
+	// check compares the blobs bucket with refs, the blob files with its keys and the other files with files
+	check := func(step string, refs map[string]int, files ...string) {
+		t.Helper()
+		gotFiles, gotBlobs := dataFiles(t)
+		blobs := make([]string, 0, len(refs))
+		for sum := range refs {
+			blobs = append(blobs, sum)
+		}
+		sort.Strings(blobs)
+		sort.Strings(files)
+		if got := blobRefs(t); !reflect.DeepEqual(got, refs) {
+			t.Errorf("%s: blob refs %v, want %v", step, got, refs)
+		}
+		if len(gotBlobs) != len(blobs) || len(blobs) > 0 && !reflect.DeepEqual(gotBlobs, blobs) {
+			t.Errorf("%s: blob files %v, want %v", step, gotBlobs, blobs)
+		}
+		if len(gotFiles) != len(files) || len(files) > 0 && !reflect.DeepEqual(gotFiles, files) {
+			t.Errorf("%s: files %v, want %v", step, gotFiles, files)
+		}
+	}
+	sameAsBlob := func(reqPath, sum string) {
+		t.Helper()
+		st, err := os.Stat(filepath.Join(svr.dataDir, reqPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bst, err := os.Stat(blobPath(sum))
+		if err != nil || !os.SameFile(st, bst) {
+			t.Errorf("%s is not a link to blob %s: %v", reqPath, sum, err)
+		}
+	}
+	transfer := func(h httprouter.Handle, src, dest string) {
+		t.Helper()
+		var resp UploadResponseInfo
+		decodeJSON(t, call(h, formRequest("POST", "/r/transfer", url.Values{"src": {src}, "dest": {dest}})), &resp)
+		if resp.Status != ERR_OK || resp.Msg != "OK" {
+			t.Fatalf("%s to %s: %+v", src, dest, resp.ErrInfo)
+		}
+	}
+
+	if f := storeFile(t, "/a.txt", "x content", nil); f.Blob != x {
+		t.Fatalf("Blob %q, want %s", f.Blob, x)
+	}
+	check("upload", map[string]int{x: 1}, "a.txt")
+	sameAsBlob("/a.txt", x)
+	storeFile(t, "/b.txt", "x content", nil)
+	check("upload of the same content", map[string]int{x: 2}, "a.txt", "b.txt")
+	sameAsBlob("/b.txt", x)
+	storeFile(t, "/a.txt", "x content", nil)
+	check("re-upload", map[string]int{x: 2}, "a.txt", "b.txt")
+	storeFile(t, "/a.txt", "y content", nil)
+	check("replace", map[string]int{x: 1, y: 1}, "a.txt", "b.txt")
+	sameAsBlob("/a.txt", y)
+
+	transfer(copyFile, "/b.txt", "/c.txt")
+	check("copy", map[string]int{x: 2, y: 1}, "a.txt", "b.txt", "c.txt")
+	sameAsBlob("/c.txt", x)
+	transfer(moveFile, "/c.txt", "/d/e.txt")
+	check("move", map[string]int{x: 2, y: 1}, "a.txt", "b.txt", "d/e.txt")
+	sameAsBlob("/d/e.txt", x)
+	transfer(moveFile, "/a.txt", "/b.txt")
+	check("move over the other content", map[string]int{x: 1, y: 1}, "b.txt", "d/e.txt")
+	sameAsBlob("/b.txt", y)
+
+	var deleted DeleteResponseInfo
+	decodeJSON(t, call(deleteFiles, httptest.NewRequest("DELETE", "/r/files/b.txt", nil),
+		httprouter.Param{Key: "filepath", Value: "/b.txt"}), &deleted)
+	if deleted.Status != ERR_OK || deleted.NumDeletedFiles != 1 {
+		t.Fatalf("delete: %+v", deleted)
+	}
+	check("delete of the last reference", map[string]int{x: 1}, "d/e.txt")
+	storeFile(t, "/f.txt", "x content", nil)
+	check("upload", map[string]int{x: 2}, "d/e.txt", "f.txt")
+	past := time.Now().Add(-time.Second)
+	if err := setExpiredTime(map[string]*FileInfo{"/d/e.txt": nil, "/f.txt": nil}, &past); err != nil {
+		t.Fatal(err)
+	}
+	deleteFilesBothDiskAndDB(getExpiredFiles())
+	check("expiry", map[string]int{})
+
+	// versions keep their blobs until they are dropped or expire
+	svr.maxVersions = 1
+	storeFile(t, "/v.txt", "x content", nil)
+	storeFile(t, "/v.txt", "y content", nil)
+	check("version", map[string]int{x: 1, y: 1}, "v.txt", VERSION_DIR+"/v.txt/1")
+	storeFile(t, "/v.txt", "z content", nil)
+	check("version over the limit", map[string]int{y: 1, z: 1}, "v.txt", VERSION_DIR+"/v.txt/2")
+	storeFile(t, "/v.txt", "z content", nil)
+	check("version of the same content", map[string]int{z: 2}, "v.txt", VERSION_DIR+"/v.txt/3")
+	storeFile(t, "/v.txt", "w content", nil)
+	check("version", map[string]int{z: 1, w: 1}, "v.txt", VERSION_DIR+"/v.txt/4")
+	db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileVersions"))
+		version := &FileInfo{}
+		if err := json.Unmarshal(b.Get(versionKey("/v.txt", 4)), version); err != nil {
+			return err
+		}
+		version.ExpiredTime = &past
+		encoded, _ := json.Marshal(version)
+		return b.Put(versionKey("/v.txt", 4), encoded)
+	})
+	deleteExpiredVersions()
+	check("version expiry", map[string]int{w: 1}, "v.txt")
+}
+
+func TestStageBlob(t *testing.T) {
+	testServer(t)
+	sum := sha256Hex("content")
+	stage := func() string {
+		f, err := createStageFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString("content")
+		f.Close()
+		return f.Name()
+	}
+	first := stage()
+	if size, created, err := stageBlob(first, sum); err != nil || !created || size != 7 {
+		t.Fatalf("new blob: %d, %v, %v", size, created, err)
+	}
+	second := stage()
+	if size, created, err := stageBlob(second, sum); err != nil || created || size != 7 {
+		t.Fatalf("existing blob: %d, %v, %v", size, created, err)
+	}
+	// a link to the blob already, like the file of a move
+	if size, created, err := stageBlob(first, sum); err != nil || created || size != 7 {
+		t.Fatalf("link to the blob: %d, %v, %v", size, created, err)
+	}
+	bst, err := os.Stat(blobPath(sum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{first, second} {
+		if st, err := os.Stat(name); err != nil || !os.SameFile(st, bst) {
+			t.Errorf("%s is not a link to the blob: %v", name, err)
+		}
+	}
+	files, _ := dataFiles(t)
+	if len(files) != 2 {
+		t.Errorf("files %v, want the 2 staged ones", files)
+	}
+}
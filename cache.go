@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// parseCacheControl parses the semicolon separated prefix=value pairs of the -cacheControl flag,
+// the values are Cache-Control headers, which have commas of their own.
+func parseCacheControl(list string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, item := range strings.Split(list, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || kv[0][0] != '/' || !validHeaderValue(kv[1]) {
+			return nil, fmt.Errorf("invalid cache control: %s", item)
+		}
+		values[path.Clean(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return values, nil
+}
+
+// cacheControl returns the Cache-Control header of reqPath by the longest matching prefix of
+// -cacheControl, "" if none matches.
+func cacheControl(reqPath string) string {
+	value, matched := "", -1
+	for prefix, v := range svr.cacheControl {
+		if (prefix == "/" || reqPath == prefix || strings.HasPrefix(reqPath, prefix+"/")) && len(prefix) > matched {
+			value, matched = v, len(prefix)
+		}
+	}
+	return value
+}
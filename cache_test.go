@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		list string
+		want map[string]string
+		ok   bool
+	}{
+		{"", map[string]string{}, true},
+		{"/release=public, max-age=86400; /nightly/=no-cache", map[string]string{"/release": "public, max-age=86400", "/nightly": "no-cache"}, true},
+		{"/=no-store;", map[string]string{"/": "no-store"}, true},
+		{"release=no-cache", nil, false},
+		{"/release", nil, false},
+		{"/release=a\nb", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseCacheControl(tt.list)
+		if (err == nil) != tt.ok || tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCacheControl(%q) = %v, %v", tt.list, got, err)
+		}
+	}
+}
+
+func TestDownloadCacheHeaders(t *testing.T) {
+	testServer(t)
+	svr.cacheControl = map[string]string{"/": "no-cache", "/release": "public, max-age=86400", "/release/nightly": "no-store"}
+	for reqPath, want := range map[string]string{
+		"/a.txt":                "no-cache",
+		"/release":              "public, max-age=86400",
+		"/release/v1/app.tgz":   "public, max-age=86400",
+		"/releases/app.tgz":     "no-cache",
+		"/release/nightly/x.gz": "no-store",
+	} {
+		if got := cacheControl(reqPath); got != want {
+			t.Errorf("cacheControl(%q) = %q, want %q", reqPath, got, want)
+		}
+	}
+
+	fileInfo := storeFile(t, "/release/v1/app.tgz", "app", nil)
+	get := func(header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/r/download/release/v1/app.tgz", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		return call(download, r, httprouter.Param{Key: "filepath", Value: "/release/v1/app.tgz"})
+	}
+	etag := `"` + fileInfo.Md5 + `"`
+	lastModified := fileInfo.CreateTime.UTC().Format(http.TimeFormat)
+	w := get(nil)
+	if w.Code != http.StatusOK || w.Body.String() != "app" {
+		t.Fatalf("download: %d %q", w.Code, w.Body.String())
+	}
+	for k, want := range map[string]string{"ETag": etag, "Last-Modified": lastModified, "Cache-Control": "public, max-age=86400"} {
+		if got := w.Header().Get(k); got != want {
+			t.Errorf("%s: %q, want %q", k, got, want)
+		}
+	}
+
+	tests := []struct {
+		header map[string]string
+		code   int
+	}{
+		{map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"other", ` + etag}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{map[string]string{"If-Modified-Since": fileInfo.CreateTime.Add(-time.Hour).UTC().Format(http.TimeFormat)}, http.StatusOK},
+		// If-None-Match goes before If-Modified-Since
+		{map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := get(tt.header)
+		if w.Code != tt.code {
+			t.Errorf("%v: %d, want %d", tt.header, w.Code, tt.code)
+		}
+		if w.Code == http.StatusNotModified && (w.Body.Len() != 0 || w.Header().Get("ETag") != etag || w.Header().Get("Cache-Control") == "") {
+			t.Errorf("%v: 304 %q %v", tt.header, w.Body.String(), w.Header())
+		}
+	}
+
+	// a replaced file has another ETag
+	storeFile(t, "/release/v1/app.tgz", "new app", nil)
+	if w := get(map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK || w.Body.String() != "new app" {
+		t.Errorf("replaced with If-None-Match: %d %q", w.Code, w.Body.String())
+	}
+}
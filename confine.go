@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"repo/log"
+	"strings"
+)
+
+// reservedDirs are the directories under dataDir which belong to the server, no request path may enter them.
+var reservedDirs = map[string]bool{
+	TMP_DIR:     true,
+	BLOB_DIR:    true,
+	VERSION_DIR: true,
+	GZIP_DIR:    true,
+}
+
+// reqPathError is returned for a request path which does not stay inside dataDir.
+type reqPathError struct {
+	reqPath string
+	reason  string
+}
+
+func (e reqPathError) Error() string {
+	return fmt.Sprintf("invalid path %q: %s", e.reqPath, e.reason)
+}
+
+// confinePath validates reqPath and returns it normalized. reqPath must be absolute, must not
+// contain control characters or ".." elements, must not enter a reserved directory and must not
+// pass a symlink which leads out of dataDir. "/" is valid and means dataDir itself.
+func confinePath(reqPath string) (string, error) {
+	if reqPath == "" || reqPath[0] != '/' {
+		return "", reqPathError{reqPath, "not absolute"}
+	}
+	for i := 0; i < len(reqPath); i++ {
+		if c := reqPath[i]; c < ' ' || c == 0x7f {
+			return "", reqPathError{reqPath, "control character"}
+		}
+	}
+	for _, elem := range strings.Split(reqPath, "/") {
+		if elem == ".." {
+			return "", reqPathError{reqPath, "escapes data directory"}
+		}
+	}
+	cleaned := path.Clean(reqPath)
+	if elems := strings.SplitN(cleaned[1:], "/", 2); reservedDirs[elems[0]] {
+		return "", reqPathError{reqPath, "reserved directory"}
+	}
+	if err := checkSymlinks(cleaned); err != nil {
+		return "", err
+	}
+	return cleaned, nil
+}
+
+// confineFilePath is confinePath for the path of a file, which can't be "/".
+func confineFilePath(reqPath string) (string, error) {
+	cleaned, err := confinePath(reqPath)
+	if err != nil {
+		return "", err
+	}
+	if cleaned == "/" {
+		return "", reqPathError{reqPath, "not a file path"}
+	}
+	return cleaned, nil
+}
+
+// checkSymlinks walks the existing elements of reqPath on disk, a symlink among them must resolve inside
+// dataDir and not into one of its reserved directories, nor may any element after it.
+func checkSymlinks(reqPath string) error {
+	root, err := filepath.EvalSymlinks(svr.dataDir)
+	if err != nil {
+		// dataDir is only missing before the first upload, then nothing below it exists either
+		return nil
+	}
+	localPath := svr.dataDir
+	linked := false
+	for _, elem := range strings.Split(strings.Trim(reqPath, "/"), "/") {
+		if elem == "" {
+			continue
+		}
+		localPath = filepath.Join(localPath, elem)
+		st, err := os.Lstat(localPath)
+		if err != nil {
+			return nil
+		}
+		if st.Mode()&os.ModeSymlink == 0 && !linked {
+			continue
+		}
+		// behind a symlink even a plain element may be a reserved directory, like .blobs of a link to dataDir
+		linked = true
+		target, err := filepath.EvalSymlinks(localPath)
+		if err != nil {
+			return reqPathError{reqPath, "broken symlink"}
+		}
+		if target != root && !strings.HasPrefix(target, root+string(os.PathSeparator)) {
+			return reqPathError{reqPath, "symlink out of data directory"}
+		}
+		rel := strings.TrimPrefix(target, root+string(os.PathSeparator))
+		if elems := strings.SplitN(rel, string(os.PathSeparator), 2); target != root && reservedDirs[elems[0]] {
+			return reqPathError{reqPath, "symlink into reserved directory"}
+		}
+	}
+	return nil
+}
+
+// isReservedDir reports whether localPath is a reserved directory of dataDir.
+func isReservedDir(localPath string) bool {
+	return path.Dir(localPath) == svr.dataDir && reservedDirs[path.Base(localPath)]
+}
+
+// writePathError writes the ERR_REQ_PARAMETER_PATH response with status 400.
+func writePathError(w http.ResponseWriter, err error) {
+	log.Warn(err)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_PATH))
+}
+
+// confined validates the filepath parameter with confinePath before h runs, h gets the normalized path.
+func confined(h httprouter.Handle) httprouter.Handle {
+	return confineParam(confinePath, h)
+}
+
+// confinedFile is confined for handlers of a single file, they don't accept "/".
+func confinedFile(h httprouter.Handle) httprouter.Handle {
+	return confineParam(confineFilePath, h)
+}
+
+func confineParam(confine func(string) (string, error), h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		reqPath, err := confine(ps.ByName("filepath"))
+		if err != nil {
+			writePathError(w, err)
+			return
+		}
+		for i := range ps {
+			if ps[i].Key == "filepath" {
+				ps[i].Value = reqPath
+			}
+		}
+		h(w, r, ps)
+	}
+}
+
+// confinedDir is an http.FileSystem of dataDir which applies confinePath to every name,
+// and hides the reserved directories from the listing of dataDir.
+type confinedDir string
+
+func (d confinedDir) Open(name string) (http.File, error) {
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	reqPath, err := confinePath(name)
+	if err != nil {
+		log.Warn(err)
+		return nil, os.ErrNotExist
+	}
+	f, err := http.Dir(d).Open(reqPath)
+	if err != nil || reqPath != "/" {
+		return f, err
+	}
+	return rootDir{f}, nil
+}
+
+type rootDir struct {
+	http.File
+}
+
+func (f rootDir) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	visible := fis[:0]
+	for _, fi := range fis {
+		if !reservedDirs[fi.Name()] {
+			visible = append(visible, fi)
+		}
+	}
+	return visible, err
+}
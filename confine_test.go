@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// confineTestDir makes svr.dataDir a temporary directory with a file, a directory, the reserved
+// directories and symlinks inside and outside of it.
+func confineTestDir(t *testing.T) {
+	dataDir := svr.dataDir
+	t.Cleanup(func() { svr.dataDir = dataDir })
+	root := t.TempDir()
+	svr.dataDir = filepath.Join(root, "data")
+	outside := filepath.Join(root, "outside")
+	for _, dir := range []string{"docs", BLOB_DIR, TMP_DIR, VERSION_DIR, GZIP_DIR} {
+		if err := os.MkdirAll(filepath.Join(svr.dataDir, dir), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(outside, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join(svr.dataDir, "docs", "a.txt"): "inside",
+		filepath.Join(svr.dataDir, BLOB_DIR, "x"):   "blob",
+		filepath.Join(outside, "secret.txt"):        "secret",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"in":     filepath.Join(svr.dataDir, "docs"),
+		"out":    outside,
+		"broken": filepath.Join(root, "missing"),
+		"blobs":  filepath.Join(svr.dataDir, BLOB_DIR),
+		"tmp":    filepath.Join(svr.dataDir, TMP_DIR),
+		"self":   svr.dataDir,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(svr.dataDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConfinePath(t *testing.T) {
+	confineTestDir(t)
+	tests := []struct {
+		reqPath string
+		want    string // "" if the path is rejected
+	}{
+		{"/", "/"},
+		{"/docs/a.txt", "/docs/a.txt"},
+		{"/docs//a.txt", "/docs/a.txt"},
+		{"/docs/./a.txt", "/docs/a.txt"},
+		{"/docs/", "/docs"},
+		{"/new/dir/file", "/new/dir/file"},
+		{"docs/a.txt", ""},
+		{"", ""},
+		{"/..", ""},
+		{"/../outside/secret.txt", ""},
+		{"/docs/../../outside", ""},
+		{"/docs/../docs/a.txt", ""},
+		{"/docs/..", ""},
+		// an encoded slash or dot is only a name, the router decodes the path before
+		{"/docs/..%2Fsecret", "/docs/..%2Fsecret"},
+		{"/docs/%2e%2e/a.txt", "/docs/%2e%2e/a.txt"},
+		{"/docs/..\\..\\x", "/docs/..\\..\\x"},
+		{"/docs/a\x00.txt", ""},
+		{"/docs/a\n.txt", ""},
+		{"/docs/a\x7f.txt", ""},
+		// reserved directories
+		{"/" + BLOB_DIR, ""},
+		{"/" + BLOB_DIR + "/x", ""},
+		{"//" + TMP_DIR + "/stage-1", ""},
+		{"/./" + VERSION_DIR + "/a", ""},
+		{"/" + GZIP_DIR + "/ab/abc.gz", ""},
+		{"/docs/" + BLOB_DIR + "/x", "/docs/" + BLOB_DIR + "/x"},
+		// symlinks
+		{"/in/a.txt", "/in/a.txt"},
+		{"/out", ""},
+		{"/out/secret.txt", ""},
+		{"/broken/x", ""},
+		{"/blobs", ""},
+		{"/blobs/x", ""},
+		{"/tmp/stage-1", ""},
+		{"/self/docs/a.txt", "/self/docs/a.txt"},
+		{"/self/" + BLOB_DIR + "/x", ""},
+		{"/self/self/" + VERSION_DIR, ""},
+	}
+	for _, tt := range tests {
+		got, err := confinePath(tt.reqPath)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("confinePath(%q) = %q, want an error", tt.reqPath, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("confinePath(%q) = %q, %v, want %q", tt.reqPath, got, err, tt.want)
+		}
+	}
+	if _, err := confineFilePath("/"); err == nil {
+		t.Error(`confineFilePath("/") is accepted`)
+	}
+	if got, err := confineFilePath("/docs/a.txt"); err != nil || got != "/docs/a.txt" {
+		t.Errorf(`confineFilePath("/docs/a.txt") = %q, %v`, got, err)
+	}
+}
+
+func TestConfinedDir(t *testing.T) {
+	confineTestDir(t)
+	server := http.FileServer(confinedDir(svr.dataDir))
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	tests := []struct {
+		target string
+		code   int
+		body   string
+	}{
+		{"/docs/a.txt", http.StatusOK, "inside"},
+		{"/in/a.txt", http.StatusOK, "inside"},
+		{"/out/secret.txt", http.StatusNotFound, ""},
+		{"/%2e%2e/outside/secret.txt", http.StatusNotFound, ""},
+		{"/docs%2F..%2F..%2Foutside%2Fsecret.txt", http.StatusNotFound, ""},
+		{"/" + BLOB_DIR + "/x", http.StatusNotFound, ""},
+		{"/" + BLOB_DIR + "%2Fx", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := get(tt.target)
+		if w.Code != tt.code || tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("GET %s = %d %q, want %d %q", tt.target, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+		if strings.Contains(w.Body.String(), "secret") || strings.Contains(w.Body.String(), "blob") {
+			t.Errorf("GET %s leaks %q", tt.target, w.Body.String())
+		}
+	}
+	// the listing of dataDir hides the reserved directories
+	w := get("/")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "docs/") {
+		t.Fatalf("GET / = %d %q", w.Code, w.Body.String())
+	}
+	for dir := range reservedDirs {
+		if strings.Contains(w.Body.String(), dir) {
+			t.Errorf("GET / lists %s: %q", dir, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"repo/log"
+	"strings"
+	"time"
+)
+
+// transferRequest is the parsed request of copy and move.
+type transferRequest struct {
+	src, dest      string
+	fileInfo       *FileInfo // FileInfo of src, with the expiry already overridden
+	replaceIfExist bool
+}
+
+// parseTransferRequest reads src, dest, expiredTime or expiredAt and replaceIfExist, it writes the error response itself.
+// The token of r needs srcRight on src and write right on dest.
+func parseTransferRequest(w http.ResponseWriter, r *http.Request, srcRight Right) (*transferRequest, bool) {
+	r.ParseMultipartForm(32 << 20)
+	src, err := confineFilePath(valuesGetDefault(r.Form, "src", ""))
+	if err != nil {
+		writePathError(w, err)
+		return nil, false
+	}
+	dest, err := confineFilePath(valuesGetDefault(r.Form, "dest", ""))
+	if err != nil {
+		writePathError(w, err)
+		return nil, false
+	}
+	if src == dest {
+		writePathError(w, reqPathError{dest, "same as src"})
+		return nil, false
+	}
+	if !checkRight(w, r, src, srcRight) || !checkRight(w, r, dest, RIGHT_WRITE) {
+		return nil, false
+	}
+	fileInfo, err := getFileInfo(src)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return nil, false
+	}
+	if fileInfo == nil {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_NOT_IN_DB))
+		return nil, false
+	}
+	if !checkFileIsExist(path.Join(svr.dataDir, src)) {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_NOT_EXIST))
+		return nil, false
+	}
+	expiredTime, expiredAt := valuesGetDefault(r.Form, "expiredTime", ""), valuesGetDefault(r.Form, "expiredAt", "")
+	if expiredTime != "" || expiredAt != "" {
+		e, err := parseExpiry(expiredTime, expiredAt, "")
+		if err != nil {
+			log.Warn(err)
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_EXPIRE))
+			return nil, false
+		}
+		fileInfo.ExpiredTime = e.ExpiredTime(time.Now())
+	}
+	replaceIfExist := valuesGetDefault(r.Form, "replaceIfExist", "true")
+	return &transferRequest{
+		src:            src,
+		dest:           dest,
+		fileInfo:       fileInfo,
+		replaceIfExist: strings.ToLower(replaceIfExist) == "true" || replaceIfExist == "1",
+	}, true
+}
+
+// checkTransferDest writes the response and returns false if dest can't be written.
+func checkTransferDest(w http.ResponseWriter, req *transferRequest) bool {
+	if st, err := os.Stat(path.Join(svr.dataDir, req.dest)); err != nil {
+		if !os.IsNotExist(err) {
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_OPEN_FILE))
+			return false
+		}
+	} else {
+		if st.IsDir() {
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_EXIST_DIR))
+			return false
+		}
+		if !req.replaceIfExist {
+			json.NewEncoder(w).Encode(UploadResponseInfo{ErrInfo: ErrInfo{Status: ERR_OK,
+				Msg: "file exist"}})
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Copy a stored file inside the server, the FileInfo (md5, create time) of src is kept
+curl -F src=/staging/app.tar.gz -F dest=/release/app.tar.gz -F expiredTime=8760h -F replaceIfExist=false "http://localhost:50010/r/copy"
+expiredTime or expiredAt is optional, the expiry of src is kept without it
+Return value is the same as upload
+*/
+func copyFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	req, ok := parseTransferRequest(w, r, RIGHT_READ)
+	if !ok || !checkTransferDest(w, req) {
+		return
+	}
+	stagePath, err := stageCopy(path.Join(svr.dataDir, req.src), req.fileInfo)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_WRITE_FILE))
+		return
+	}
+	defer os.Remove(stagePath) // fails harmlessly once the staging file has been published
+	fileInfo := *req.fileInfo
+	fileInfo.Blob = ""
+	fileInfo.DownloadPath = ""
+	if errCode := publishFile(stagePath, req.dest, &fileInfo); errCode != ERR_OK {
+		json.NewEncoder(w).Encode(MakeErrInfo(errCode))
+		return
+	}
+	fileInfo.DownloadPath = downloadPath(r, req.dest, nil)
+	json.NewEncoder(w).Encode(UploadResponseInfo{
+		ErrInfo: MakeErrInfo(ERR_OK),
+		File:    fileInfo,
+	})
+}
+
+// stageCopy stages a copy of the stored file at srcPath, which is described by fileInfo.
+// A deduplicated file is linked to its blob, publish takes a new reference then.
+func stageCopy(srcPath string, fileInfo *FileInfo) (string, error) {
+	f, err := createStageFile()
+	if err != nil {
+		return "", err
+	}
+	stagePath := f.Name()
+	if fileInfo.Blob != "" && svr.dedup {
+		f.Close()
+		os.Remove(stagePath)
+		err = os.Link(blobPath(fileInfo.Blob), stagePath)
+	} else {
+		err = copyContent(f, srcPath)
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(stagePath)
+		return "", err
+	}
+	return stagePath, nil
+}
+
+// copyContent copies the file at srcPath into f and syncs it.
+func copyContent(f *os.File, srcPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := io.Copy(f, src); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+/*
+Move or rename a stored file inside the server, the FileInfo (md5, create time) of src is kept,
+the record of src goes away in the same transaction which writes dest
+curl -F src=/staging/app.tar.gz -F dest=/release/app.tar.gz -F replaceIfExist=false "http://localhost:50010/r/move"
+Return value is the same as upload
+*/
+func moveFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	req, ok := parseTransferRequest(w, r, RIGHT_WRITE)
+	if !ok || !checkTransferDest(w, req) {
+		return
+	}
+	fileInfo := *req.fileInfo
+	fileInfo.DownloadPath = ""
+	if errCode := publish(path.Join(svr.dataDir, req.src), req.dest, &fileInfo, req.src); errCode != ERR_OK {
+		json.NewEncoder(w).Encode(MakeErrInfo(errCode))
+		return
+	}
+	fileInfo.DownloadPath = downloadPath(r, req.dest, nil)
+	json.NewEncoder(w).Encode(UploadResponseInfo{
+		ErrInfo: MakeErrInfo(ERR_OK),
+		File:    fileInfo,
+	})
+}
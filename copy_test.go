@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// transfer runs copyFile or moveFile with the form fields and returns its response.
+func transfer(t *testing.T, h httprouter.Handle, fields url.Values) UploadResponseInfo {
+	t.Helper()
+	var resp UploadResponseInfo
+	decodeJSON(t, call(h, formRequest("POST", "/r/transfer", fields)), &resp)
+	return resp
+}
+
+func TestCopyFile(t *testing.T) {
+	testServer(t)
+	src := storeFile(t, "/staging/app.tgz", "app", url.Values{"expiredTime": {"1h"}})
+	storeFile(t, "/release/old.tgz", "old", nil)
+
+	resp := transfer(t, copyFile, url.Values{"src": {"/staging/app.tgz"}, "dest": {"/release/app.tgz"}})
+	if resp.Status != ERR_OK || resp.Msg != "OK" || resp.File.Md5 != src.Md5 || !resp.File.CreateTime.Equal(src.CreateTime) {
+		t.Fatalf("copy: %+v", resp)
+	}
+	if !resp.File.ExpiredTime.Equal(*src.ExpiredTime) {
+		t.Errorf("expiry of src is not kept: %v", resp.File.ExpiredTime)
+	}
+	for _, reqPath := range []string{"/staging/app.tgz", "/release/app.tgz"} {
+		if fileInfo, err := getFileInfo(reqPath); err != nil || fileInfo == nil || readStored(t, reqPath) != "app" {
+			t.Errorf("%s: %+v, %v", reqPath, fileInfo, err)
+		}
+	}
+	resp = transfer(t, copyFile, url.Values{"src": {"/staging/app.tgz"}, "dest": {"/release/never.tgz"}, "expiredTime": {"never"}})
+	if resp.Status != ERR_OK || resp.File.ExpiredTime != nil {
+		t.Errorf("copy with expiredTime=never: %+v", resp)
+	}
+	if fileInfo, _ := getFileInfo("/staging/app.tgz"); fileInfo.ExpiredTime == nil {
+		t.Error("the expiry of src is changed")
+	}
+
+	resp = transfer(t, copyFile, url.Values{"src": {"/staging/app.tgz"}, "dest": {"/release/old.tgz"}, "replaceIfExist": {"false"}})
+	if resp.Status != ERR_OK || resp.Msg != "file exist" || readStored(t, "/release/old.tgz") != "old" {
+		t.Errorf("replaceIfExist=false: %+v", resp.ErrInfo)
+	}
+	resp = transfer(t, copyFile, url.Values{"src": {"/staging/app.tgz"}, "dest": {"/release/old.tgz"}})
+	if resp.Status != ERR_OK || resp.Msg != "OK" || readStored(t, "/release/old.tgz") != "app" {
+		t.Errorf("replace: %+v", resp.ErrInfo)
+	}
+
+	for _, tt := range []struct {
+		fields url.Values
+		want   ErrCode
+	}{
+		{url.Values{"src": {"/staging/app.tgz"}, "dest": {"/release"}}, ERR_FILE_EXIST_DIR},
+		{url.Values{"src": {"/staging/app.tgz"}, "dest": {"/staging/app.tgz"}}, ERR_REQ_PARAMETER_PATH},
+		{url.Values{"src": {"/staging/none.tgz"}, "dest": {"/release/none.tgz"}}, ERR_FILE_NOT_IN_DB},
+		{url.Values{"src": {"/staging/app.tgz"}, "dest": {"/release/x.tgz"}, "expiredTime": {"soon"}}, ERR_REQ_PARAMETER_EXPIRE},
+	} {
+		if resp := transfer(t, copyFile, tt.fields); resp.Status != tt.want {
+			t.Errorf("%v: %+v, want %d", tt.fields, resp.ErrInfo, tt.want)
+		}
+	}
+	if readStored(t, "/release/x.tgz") != "" || readStored(t, "/release/none.tgz") != "" {
+		t.Error("a rejected copy is stored")
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	testServer(t)
+	src := storeFile(t, "/staging/v1/app.tgz", "app", nil)
+	storeFile(t, "/release/old.tgz", "old", nil)
+
+	resp := transfer(t, moveFile, url.Values{"src": {"/staging/v1/app.tgz"}, "dest": {"/release/old.tgz"}, "replaceIfExist": {"false"}})
+	if resp.Status != ERR_OK || resp.Msg != "file exist" || readStored(t, "/staging/v1/app.tgz") != "app" || readStored(t, "/release/old.tgz") != "old" {
+		t.Fatalf("replaceIfExist=false: %+v", resp.ErrInfo)
+	}
+	if resp := transfer(t, moveFile, url.Values{"src": {"/staging/v1/app.tgz"}, "dest": {"/release"}}); resp.Status != ERR_FILE_EXIST_DIR {
+		t.Errorf("dest is a directory: %+v", resp.ErrInfo)
+	}
+
+	resp = transfer(t, moveFile, url.Values{"src": {"/staging/v1/app.tgz"}, "dest": {"/release/old.tgz"}, "expiredTime": {"2h"}})
+	if resp.Status != ERR_OK || resp.Msg != "OK" || resp.File.Md5 != src.Md5 || !resp.File.CreateTime.Equal(src.CreateTime) {
+		t.Fatalf("move: %+v", resp)
+	}
+	if resp.File.ExpiredTime == nil || time.Until(*resp.File.ExpiredTime) > 2*time.Hour {
+		t.Errorf("ExpiredTime %v", resp.File.ExpiredTime)
+	}
+	if readStored(t, "/release/old.tgz") != "app" {
+		t.Error("dest is not replaced")
+	}
+	if fileInfo, err := getFileInfo("/staging/v1/app.tgz"); err != nil || fileInfo != nil {
+		t.Errorf("the record of src is kept: %+v, %v", fileInfo, err)
+	}
+	if fileInfo, err := getFileInfo("/release/old.tgz"); err != nil || fileInfo == nil || fileInfo.Md5 != src.Md5 {
+		t.Errorf("the record of dest: %+v, %v", fileInfo, err)
+	}
+	// the directories which became empty go away with src
+	if _, err := os.Stat(filepath.Join(svr.dataDir, "staging")); !os.IsNotExist(err) {
+		t.Errorf("empty directories of src are kept: %v", err)
+	}
+	if resp := transfer(t, moveFile, url.Values{"src": {"/staging/v1/app.tgz"}, "dest": {"/app.tgz"}}); resp.Status != ERR_FILE_NOT_IN_DB {
+		t.Errorf("move of a moved file: %+v", resp.ErrInfo)
+	}
+}
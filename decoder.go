@@ -0,0 +1,193 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// requestDecoders decode an uploaded body, keyed by the Content-Encoding token.
+var requestDecoders = map[string]func(io.Reader) (io.ReadCloser, error){
+	"identity": func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(r), nil
+	},
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"x-gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	// "deflate" in HTTP is the zlib format
+	"deflate": func(r io.Reader) (io.ReadCloser, error) {
+		return zlib.NewReader(r)
+	},
+	"br": func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	},
+	"zstd": func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	},
+}
+
+// unsupportedEncodingError is returned for a Content-Encoding without decoder.
+type unsupportedEncodingError string
+
+func (e unsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported Content-Encoding: %s", string(e))
+}
+
+// contentEncodings returns the Content-Encoding tokens of header in the order they were applied.
+func contentEncodings(header http.Header) []string {
+	encodings := make([]string, 0, 2)
+	for _, v := range header["Content-Encoding"] {
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.ToLower(strings.TrimSpace(token)); token != "" {
+				encodings = append(encodings, token)
+			}
+		}
+	}
+	return encodings
+}
+
+// RATIO_CHECK_MIN is how many bytes may be decoded before maxCompressionRatio is enforced,
+// small uploads like a run of zeros legitimately have a huge ratio.
+const RATIO_CHECK_MIN = 1 << 20
+
+var (
+	errDecodedTooLarge = errors.New("decoded content exceeds maxDecodedSize")
+	errRatioTooHigh    = errors.New("compression ratio exceeds maxCompressionRatio")
+)
+
+// corruptContentError is returned when an encoded upload can't be decoded.
+type corruptContentError struct {
+	err error
+}
+
+func (e corruptContentError) Error() string {
+	return fmt.Sprintf("corrupt content: %v", e.err)
+}
+
+// countingReader counts the bytes read from the request body and keeps its error.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+	return n, err
+}
+
+// contentDecoder is the decoded content of an upload, it enforces the decoding limits
+// and tells corrupt content apart from a broken connection.
+type contentDecoder struct {
+	io.Reader
+	raw     *countingReader
+	closers []io.Closer
+	encoded bool // false if there is nothing to decode
+	n       int64
+}
+
+func (d *contentDecoder) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	d.n += int64(n)
+	if err != nil && err != io.EOF {
+		return n, d.wrap(err)
+	}
+	if d.encoded {
+		if limitErr := checkDecodeLimits(d.n, d.raw.n); limitErr != nil {
+			return n, limitErr
+		}
+	}
+	return n, err
+}
+
+// checkDecodeLimits checks decoded bytes expanded from raw bytes against maxDecodedSize and maxCompressionRatio.
+func checkDecodeLimits(decoded, raw int64) error {
+	if svr.maxDecodedSize > 0 && decoded > svr.maxDecodedSize {
+		return errDecodedTooLarge
+	}
+	if svr.maxCompressionRatio > 0 && decoded > RATIO_CHECK_MIN && float64(decoded) > svr.maxCompressionRatio*float64(raw) {
+		return errRatioTooHigh
+	}
+	return nil
+}
+
+// wrap returns the error of the body as is, everything else means the encoded content is bad.
+func (d *contentDecoder) wrap(err error) error {
+	if d.raw.err != nil || !d.encoded {
+		return err
+	}
+	return corruptContentError{err}
+}
+
+// Close closes every stacked decoder, from the outermost one.
+func (d *contentDecoder) Close() (err error) {
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if e := d.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// newContentDecoder decodes content by the Content-Encoding of header. Stacked encodings,
+// like "gzip, zstd", are decoded in the reverse order of how they were applied.
+func newContentDecoder(header http.Header, content io.Reader) (*contentDecoder, error) {
+	encodings := contentEncodings(header)
+	for _, encoding := range encodings {
+		if _, ok := requestDecoders[encoding]; !ok {
+			return nil, unsupportedEncodingError(encoding)
+		}
+	}
+	raw := &countingReader{r: content}
+	decoded := &contentDecoder{Reader: raw, raw: raw}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		rc, err := requestDecoders[encodings[i]](decoded.Reader)
+		if err != nil {
+			decoded.Close()
+			decoded.encoded = true
+			return nil, decoded.wrap(fmt.Errorf("%s decoder: %v", encodings[i], err))
+		}
+		decoded.Reader = rc
+		decoded.closers = append(decoded.closers, rc)
+		decoded.encoded = decoded.encoded || encodings[i] != "identity"
+	}
+	return decoded, nil
+}
+
+// contentErrCode maps an error of receiving an upload to the ErrCode of the response.
+func contentErrCode(err error) ErrCode {
+	switch err.(type) {
+	case unsupportedEncodingError:
+		return ERR_UNSUPPORTED_ENCODING
+	case corruptContentError:
+		return ERR_CORRUPT_CONTENT
+	case *os.PathError:
+		return ERR_WRITE_FILE
+	}
+	switch err {
+	case errDecodedTooLarge:
+		return ERR_CONTENT_TOO_LARGE
+	case errRatioTooHigh:
+		return ERR_COMPRESSION_RATIO
+	}
+	return ERR_HTTP_GET_CONTENT
+}
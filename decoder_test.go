@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/andybalholm/brotli"
+	"github.com/julienschmidt/httprouter"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckDecodeLimits(t *testing.T) {
+	defer func(size int64, ratio float64) {
+		svr.maxDecodedSize, svr.maxCompressionRatio = size, ratio
+	}(svr.maxDecodedSize, svr.maxCompressionRatio)
+	tests := []struct {
+		maxSize  int64
+		maxRatio float64
+		decoded  int64
+		raw      int64
+		want     error
+	}{
+		{0, 0, 1 << 40, 1, nil},
+		{100 << 20, 0, 100 << 20, 1, nil},
+		{100 << 20, 0, 100<<20 + 1, 1 << 30, errDecodedTooLarge},
+		{0, 100, 100 << 20, 1 << 20, nil},
+		{0, 100, 100<<20 + 1, 1 << 20, errRatioTooHigh},
+		// small content is let through whatever its ratio
+		{0, 100, RATIO_CHECK_MIN, 1, nil},
+		{0, 100, RATIO_CHECK_MIN + 1, 1, errRatioTooHigh},
+		{10, 100, 1 << 30, 1, errDecodedTooLarge},
+	}
+	for _, tt := range tests {
+		svr.maxDecodedSize, svr.maxCompressionRatio = tt.maxSize, tt.maxRatio
+		if got := checkDecodeLimits(tt.decoded, tt.raw); got != tt.want {
+			t.Errorf("checkDecodeLimits(%d, %d) with size %d, ratio %v = %v, want %v",
+				tt.decoded, tt.raw, tt.maxSize, tt.maxRatio, got, tt.want)
+		}
+	}
+}
+
+// encode applies the Content-Encoding codings to content in order.
+func encode(t *testing.T, content []byte, codings ...string) []byte {
+	t.Helper()
+	for _, coding := range codings {
+		var buf bytes.Buffer
+		var enc io.WriteCloser
+		var err error
+		switch coding {
+		case "gzip", "x-gzip":
+			enc = gzip.NewWriter(&buf)
+		case "deflate":
+			enc = zlib.NewWriter(&buf)
+		case "br":
+			enc = brotli.NewWriter(&buf)
+		case "zstd":
+			enc, err = zstd.NewWriter(&buf)
+		case "identity":
+			buf.Write(content)
+			content = buf.Bytes()
+			continue
+		default:
+			t.Fatalf("no encoder of %s", coding)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc.Write(content)
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		content = buf.Bytes()
+	}
+	return content
+}
+
+func TestContentEncodings(t *testing.T) {
+	tests := []struct {
+		header []string
+		want   []string
+	}{
+		{nil, []string{}},
+		{[]string{"gzip"}, []string{"gzip"}},
+		{[]string{"GZIP , zstd"}, []string{"gzip", "zstd"}},
+		{[]string{"br", "identity,,deflate"}, []string{"br", "identity", "deflate"}},
+	}
+	for _, tt := range tests {
+		if got := contentEncodings(http.Header{"Content-Encoding": tt.header}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("contentEncodings(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNewContentDecoder(t *testing.T) {
+	content := []byte(strings.Repeat("decoded content ", 1000))
+	tests := []struct {
+		encoding string
+		body     []byte
+		want     error // type of the error of newContentDecoder or of reading, nil if content is decoded
+	}{
+		{"", content, nil},
+		{"identity", content, nil},
+		{"gzip", encode(t, content, "gzip"), nil},
+		{"x-gzip", encode(t, content, "gzip"), nil},
+		{"deflate", encode(t, content, "deflate"), nil},
+		{"br", encode(t, content, "br"), nil},
+		{"zstd", encode(t, content, "zstd"), nil},
+		// stacked codings are listed in the order they were applied
+		{"gzip, zstd", encode(t, content, "gzip", "zstd"), nil},
+		{"br, identity, deflate", encode(t, content, "br", "deflate"), nil},
+		{"compress", content, unsupportedEncodingError("")},
+		{"gzip, lzma", content, unsupportedEncodingError("")},
+		{"gzip", content, corruptContentError{}},
+		{"zstd, gzip", encode(t, content, "gzip", "zstd"), corruptContentError{}},
+		{"deflate", encode(t, content, "deflate")[:20], corruptContentError{}},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.encoding != "" {
+			header.Set("Content-Encoding", tt.encoding)
+		}
+		decoded, err := newContentDecoder(header, bytes.NewReader(tt.body))
+		var got []byte
+		if err == nil {
+			got, err = ioutil.ReadAll(decoded)
+			decoded.Close()
+		}
+		if tt.want == nil {
+			if err != nil || !bytes.Equal(got, content) {
+				t.Errorf("%q: decoded %d bytes, %v", tt.encoding, len(got), err)
+			}
+			continue
+		}
+		if reflect.TypeOf(err) != reflect.TypeOf(tt.want) {
+			t.Errorf("%q: error %T %v, want %T", tt.encoding, err, err, tt.want)
+		}
+	}
+}
+
+func TestUploadContentEncoding(t *testing.T) {
+	testServer(t)
+	content := strings.Repeat("decoded content ", 1000)
+	for _, encoding := range []string{"gzip", "deflate", "br", "zstd"} {
+		r := httptest.NewRequest("PUT", "/r/upload/a.txt", bytes.NewReader(encode(t, []byte(content), encoding)))
+		r.Header.Set("Content-Encoding", encoding)
+		var resp UploadResponseInfo
+		decodeJSON(t, call(uploadRaw, r, httprouter.Param{Key: "filepath", Value: "/a.txt"}), &resp)
+		if resp.Status != ERR_OK || resp.File.Size != int64(len(content)) || readStored(t, "/a.txt") != content {
+			t.Errorf("%s: %+v", encoding, resp)
+		}
+	}
+	for encoding, want := range map[string]ErrCode{"compress": ERR_UNSUPPORTED_ENCODING, "gzip": ERR_CORRUPT_CONTENT} {
+		r := httptest.NewRequest("PUT", "/r/upload/b.txt", strings.NewReader(content))
+		r.Header.Set("Content-Encoding", encoding)
+		var resp UploadResponseInfo
+		decodeJSON(t, call(uploadRaw, r, httprouter.Param{Key: "filepath", Value: "/b.txt"}), &resp)
+		if resp.Status != want || readStored(t, "/b.txt") != "" {
+			t.Errorf("%s: %+v, want %d", encoding, resp.ErrInfo, want)
+		}
+	}
+}
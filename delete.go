@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"repo/log"
+	"strings"
+)
+
+// DeleteResponseInfo is the response of deleting files, it is also returned by clean.
+type DeleteResponseInfo struct {
+	ErrInfo
+	NumDeletedFiles    int
+	DeletedFiles       map[string]*FileInfo
+	NumDeletedVersions int `json:",omitempty"` // with versions=true
+}
+
+// getFilesUnder reads the FileInfo of reqPath, and with recursive also of every file under reqPath.
+func getFilesUnder(reqPath string, recursive bool) (map[string]*FileInfo, error) {
+	files := make(map[string]*FileInfo)
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileInfo"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		if v := b.Get([]byte(reqPath)); v != nil {
+			fileInfo := &FileInfo{}
+			if err := json.Unmarshal(v, fileInfo); err != nil {
+				return err
+			}
+			files[reqPath] = fileInfo
+		}
+		if !recursive {
+			return nil
+		}
+		prefix := strings.TrimSuffix(reqPath, "/") + "/"
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			fileInfo := &FileInfo{}
+			if err := json.Unmarshal(v, fileInfo); err != nil {
+				log.Errorf("%s: %v", k, err)
+				continue
+			}
+			files[string(k)] = fileInfo
+		}
+		return nil
+	})
+	return files, err
+}
+
+/*
+Delete a file, or with recursive=true every file under a directory, empty parent directories are removed too
+curl -X DELETE "http://localhost:50010/r/files/jianwang/bolt.txt"
+curl -X DELETE "http://localhost:50010/r/files/jianwang?recursive=true"
+The versions kept of a versioned file stay, they can be restored until they expire. With versions=true they are
+deleted too, also the versions of a file which is already gone, like the ones which never expire:
+curl -X DELETE "http://localhost:50010/r/files/jianwang?recursive=true&versions=true"
+Return value:
+{"Status":0,"Msg":"OK","NumDeletedFiles":1,"DeletedFiles":{"/jianwang/bolt.txt":{"CreateTime":"...","Md5":"...","ExpiredTime":"..."}}}
+*/
+func deleteFiles(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	reqPath := ps.ByName("filepath") // confined, the whole store is never removed at once
+	r.ParseForm()
+	recursive := valuesGetDefault(r.Form, "recursive", "false")
+	isRecursive := strings.ToLower(recursive) == "true" || recursive == "1"
+	files, err := getFilesUnder(reqPath, isRecursive)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	versions := make(map[string][]*FileInfo)
+	if withVersions := valuesGetDefault(r.Form, "versions", "false"); strings.ToLower(withVersions) == "true" || withVersions == "1" {
+		if versions, err = getVersionsUnder(reqPath, isRecursive); err != nil {
+			log.Error(err)
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+			return
+		}
+	}
+	if len(files) == 0 && len(versions) == 0 {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_NOT_IN_DB))
+		return
+	}
+	deleteFilesBothDiskAndDB(files)
+	numVersions := 0
+	for _, kept := range versions {
+		numVersions += len(kept)
+	}
+	deleteVersions(versions)
+	log.Infof("delete %s: %d files, %d versions", reqPath, len(files), numVersions)
+	json.NewEncoder(w).Encode(DeleteResponseInfo{
+		ErrInfo:            MakeErrInfo(ERR_OK),
+		NumDeletedFiles:    len(files),
+		DeletedFiles:       files,
+		NumDeletedVersions: numVersions,
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeleteFiles(t *testing.T) {
+	testServer(t)
+	for _, reqPath := range []string{"/team/a.txt", "/team/v1/b.txt", "/team/v1/c/d.txt", "/teams/e.txt"} {
+		storeFile(t, reqPath, reqPath, nil)
+	}
+	remove := func(target, reqPath string) DeleteResponseInfo {
+		var resp DeleteResponseInfo
+		decodeJSON(t, call(deleteFiles, httptest.NewRequest("DELETE", target, nil), httprouter.Param{Key: "filepath", Value: reqPath}), &resp)
+		return resp
+	}
+	exists := func(reqPath string) bool {
+		_, err := os.Stat(filepath.Join(svr.dataDir, reqPath))
+		return err == nil
+	}
+
+	resp := remove("/r/files/team/v1/c/d.txt", "/team/v1/c/d.txt")
+	if resp.Status != ERR_OK || resp.NumDeletedFiles != 1 || resp.DeletedFiles["/team/v1/c/d.txt"] == nil {
+		t.Fatalf("delete a file: %+v", resp)
+	}
+	if exists("/team/v1/c") || !exists("/team/v1/b.txt") {
+		t.Error("the empty directory of the file is kept, or its sibling is removed")
+	}
+	if resp := remove("/r/files/team/v1/c/d.txt", "/team/v1/c/d.txt"); resp.Status != ERR_FILE_NOT_IN_DB {
+		t.Errorf("delete a deleted file: %+v", resp.ErrInfo)
+	}
+	// a directory is deleted only with recursive
+	if resp := remove("/r/files/team", "/team"); resp.Status != ERR_FILE_NOT_IN_DB || !exists("/team/a.txt") {
+		t.Errorf("delete a directory: %+v", resp.ErrInfo)
+	}
+	resp = remove("/r/files/team?recursive=true", "/team")
+	if resp.Status != ERR_OK || resp.NumDeletedFiles != 2 || resp.DeletedFiles["/team/a.txt"] == nil || resp.DeletedFiles["/team/v1/b.txt"] == nil {
+		t.Fatalf("delete recursive: %+v", resp)
+	}
+	if exists("/team") {
+		t.Error("the emptied directory is kept")
+	}
+	// the prefix matches whole path elements only
+	if fileInfo, err := getFileInfo("/teams/e.txt"); err != nil || fileInfo == nil || !exists("/teams/e.txt") {
+		t.Errorf("/teams/e.txt is deleted: %v", err)
+	}
+	for _, reqPath := range []string{"/team/a.txt", "/team/v1/b.txt"} {
+		if fileInfo, err := getFileInfo(reqPath); err != nil || fileInfo != nil {
+			t.Errorf("the record of %s is kept: %+v, %v", reqPath, fileInfo, err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"repo/log"
+	"sort"
+	"strings"
+)
+
+// digestHashes are the digest algorithms the server can compute, keyed by the name used in FileInfo.Digests.
+var digestHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+}
+
+// digestHeaderNames are the names of the algorithms in the HTTP digest algorithm registry.
+var digestHeaderNames = map[string]string{
+	"md5":    "md5",
+	"sha256": "sha-256",
+	"sha512": "sha-512",
+	"crc32c": "crc32c",
+}
+
+// parseDigestList parses the comma separated algorithms of the -digests flag.
+func parseDigestList(list string) ([]string, error) {
+	algos := make([]string, 0, 4)
+	for _, algo := range strings.Split(list, ",") {
+		algo = strings.ToLower(strings.TrimSpace(algo))
+		if algo == "" || algo == "md5" { // md5 is always computed
+			continue
+		}
+		if _, ok := digestHashes[algo]; !ok {
+			return nil, fmt.Errorf("unknown digest algorithm: %s", algo)
+		}
+		algos = append(algos, algo)
+	}
+	return algos, nil
+}
+
+// computesDigest reports whether algo is computed for every upload.
+func computesDigest(algo string) bool {
+	if algo == "md5" {
+		return true
+	}
+	for _, a := range svr.digests {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// digester computes all its digests in one pass, it always has md5.
+type digester map[string]hash.Hash
+
+// newDigester creates a digester for md5, the configured digests and the algorithms of checksums.
+func newDigester(checksums map[string][]byte) digester {
+	d := digester{"md5": md5.New()}
+	for _, algo := range svr.digests {
+		d[algo] = digestHashes[algo]()
+	}
+	if _, ok := d["sha256"]; svr.dedup && !ok {
+		// blobs are keyed by sha256
+		d["sha256"] = sha256.New()
+	}
+	for algo := range checksums {
+		if _, ok := d[algo]; !ok {
+			d[algo] = digestHashes[algo]()
+		}
+	}
+	return d
+}
+
+func (d digester) Write(p []byte) (int, error) {
+	for _, h := range d {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+func (d digester) Md5() string {
+	return fmt.Sprintf("%x", d["md5"].Sum(nil))
+}
+
+// Digests returns the hex digests other than md5, which has its own field in FileInfo.
+func (d digester) Digests() map[string]string {
+	if len(d) <= 1 {
+		return nil
+	}
+	digests := make(map[string]string, len(d)-1)
+	for algo, h := range d {
+		if algo != "md5" {
+			digests[algo] = fmt.Sprintf("%x", h.Sum(nil))
+		}
+	}
+	return digests
+}
+
+// Verify compares the computed digests with checksums, it returns the first mismatched algorithm.
+func (d digester) Verify(checksums map[string][]byte) (string, bool) {
+	for algo, expected := range checksums {
+		h, ok := d[algo]
+		if !ok || !bytes.Equal(h.Sum(nil), expected) {
+			return algo, false
+		}
+	}
+	return "", true
+}
+
+// State marshals the intermediate state of every digest, so the computation can be resumed.
+func (d digester) State() (map[string][]byte, error) {
+	state := make(map[string][]byte, len(d))
+	for algo, h := range d {
+		b, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		state[algo] = b
+	}
+	return state, nil
+}
+
+// Restore resumes the digests from state. A digest without state is dropped,
+// as it can't cover the data which has been written before.
+func (d digester) Restore(state map[string][]byte) error {
+	for algo, h := range d {
+		b, ok := state[algo]
+		if !ok {
+			delete(d, algo)
+			continue
+		}
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setDigestHeaders sends the digests of fileInfo as Digest and Repr-Digest response headers.
+func setDigestHeaders(header http.Header, fileInfo *FileInfo) {
+	digests := map[string]string{"md5": fileInfo.Md5}
+	for algo, v := range fileInfo.Digests {
+		digests[algo] = v
+	}
+	algos := make([]string, 0, len(digests))
+	for algo := range digests {
+		algos = append(algos, algo)
+	}
+	sort.Strings(algos)
+	digest := make([]string, 0, len(algos))
+	reprDigest := make([]string, 0, len(algos))
+	for _, algo := range algos {
+		name, ok := digestHeaderNames[algo]
+		sum, err := hex.DecodeString(digests[algo])
+		if !ok || err != nil || len(sum) == 0 {
+			continue
+		}
+		b64 := base64.StdEncoding.EncodeToString(sum)
+		digest = append(digest, name+"="+b64)
+		reprDigest = append(reprDigest, name+"=:"+b64+":")
+	}
+	if len(digest) > 0 {
+		header.Set("Digest", strings.Join(digest, ","))
+		header.Set("Repr-Digest", strings.Join(reprDigest, ", "))
+	}
+}
+
+// parseChecksums collects the expected digests of an upload, they come from the X-Checksum-<Algo> headers
+// or the <algo> fields of values, in hex. The digests are of the stored content, i.e. after Content-Encoding
+// is decoded. Content-MD5 is not one of them, it describes the body as it is sent, see checkContentMD5.
+func parseChecksums(header http.Header, values url.Values) (map[string][]byte, error) {
+	checksums := make(map[string][]byte)
+	for algo, newHash := range digestHashes {
+		for _, v := range []string{header.Get("X-Checksum-" + algo), values.Get(algo)} {
+			if v == "" {
+				continue
+			}
+			sum, err := hex.DecodeString(v)
+			if err != nil || len(sum) != newHash().Size() {
+				return nil, fmt.Errorf("invalid %s checksum: %s", algo, v)
+			}
+			if old, ok := checksums[algo]; ok && !bytes.Equal(old, sum) {
+				return nil, fmt.Errorf("conflicting %s checksums: %x, %x", algo, old, sum)
+			}
+			checksums[algo] = sum
+		}
+	}
+	return checksums, nil
+}
+
+// checkContentMD5 starts computing the md5 of the body of r as it is sent, before Content-Encoding
+// is decoded and with the multipart framing of a form, which is what a Content-MD5 header declares.
+// The returned func reads what is left of the body and reports whether the md5 matches,
+// it is nil if r has no Content-MD5.
+func checkContentMD5(r *http.Request) (func() bool, error) {
+	v := r.Header.Get("Content-MD5")
+	if v == "" {
+		return nil, nil
+	}
+	expected, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(expected) != md5.Size {
+		return nil, fmt.Errorf("invalid Content-MD5: %s", v)
+	}
+	h := md5.New()
+	body := r.Body
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, h), body}
+	return func() bool {
+		io.Copy(ioutil.Discard, r.Body)
+		if sum := h.Sum(nil); !bytes.Equal(sum, expected) {
+			log.Warnf("Content-MD5 mismatch, expected: %x, got: %x", expected, sum)
+			return false
+		}
+		return true
+	}, nil
+}
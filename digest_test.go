@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/julienschmidt/httprouter"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseChecksums(t *testing.T) {
+	sum := md5.Sum([]byte("content"))
+	hexSum := hex.EncodeToString(sum[:])
+	sha256Sum := strings.Repeat("ab", 32)
+	tests := []struct {
+		header http.Header
+		values url.Values
+		want   map[string]string // hex digests by algorithm, nil if the checksums are rejected
+	}{
+		{nil, nil, map[string]string{}},
+		{http.Header{"X-Checksum-Md5": {hexSum}}, nil, map[string]string{"md5": hexSum}},
+		{nil, url.Values{"sha256": {sha256Sum}, "md5": {hexSum}}, map[string]string{"sha256": sha256Sum, "md5": hexSum}},
+		{http.Header{"X-Checksum-Sha256": {sha256Sum}}, url.Values{"sha256": {sha256Sum}}, map[string]string{"sha256": sha256Sum}},
+		// Content-MD5 describes the body as it is sent, not the stored content
+		{http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}, nil, map[string]string{}},
+		{http.Header{"X-Checksum-Sha256": {sha256Sum}}, url.Values{"sha256": {strings.Repeat("cd", 32)}}, nil},
+		{http.Header{"X-Checksum-Md5": {"abc"}}, nil, nil},
+		{nil, url.Values{"crc32c": {hexSum}}, nil},
+	}
+	for _, tt := range tests {
+		checksums, err := parseChecksums(tt.header, tt.values)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseChecksums(%v, %v) = %x, want an error", tt.header, tt.values, checksums)
+			}
+			continue
+		}
+		got := make(map[string]string)
+		for algo, sum := range checksums {
+			got[algo] = hex.EncodeToString(sum)
+		}
+		if err != nil || len(got) != len(tt.want) {
+			t.Errorf("parseChecksums(%v, %v) = %v, %v, want %v", tt.header, tt.values, got, err, tt.want)
+			continue
+		}
+		for algo, sum := range tt.want {
+			if got[algo] != sum {
+				t.Errorf("parseChecksums(%v, %v) = %v, want %v", tt.header, tt.values, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestContentMD5(t *testing.T) {
+	testServer(t)
+	contentMD5 := func(b []byte) string {
+		sum := md5.Sum(b)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	content := []byte(strings.Repeat("content ", 100))
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(content)
+	gw.Close()
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("dest", "/form.txt")
+	fw, _ := mw.CreateFormFile("file", "form.txt")
+	fw.Write(content)
+	mw.Close()
+
+	put := func(body []byte, header map[string]string) ErrCode {
+		r := httptest.NewRequest("PUT", "/r/upload/raw.txt", bytes.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		var resp UploadResponseInfo
+		decodeJSON(t, call(uploadRaw, r, httprouter.Param{Key: "filepath", Value: "/raw.txt"}), &resp)
+		return resp.Status
+	}
+	post := func(header map[string]string) ErrCode {
+		r := httptest.NewRequest("POST", "/r/upload/", bytes.NewReader(form.Bytes()))
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		var resp UploadResponseInfo
+		decodeJSON(t, call(upload, r), &resp)
+		return resp.Status
+	}
+	tests := []struct {
+		name string
+		send func() ErrCode
+		want ErrCode
+	}{
+		{"raw", func() ErrCode { return put(content, map[string]string{"Content-MD5": contentMD5(content)}) }, ERR_OK},
+		{"raw mismatch", func() ErrCode { return put(content, map[string]string{"Content-MD5": contentMD5(gzipped.Bytes())}) }, ERR_CHECKSUM_MISMATCH},
+		{"gzip of the encoded body", func() ErrCode {
+			return put(gzipped.Bytes(), map[string]string{"Content-Encoding": "gzip", "Content-MD5": contentMD5(gzipped.Bytes())})
+		}, ERR_OK},
+		{"gzip of the decoded content", func() ErrCode {
+			return put(gzipped.Bytes(), map[string]string{"Content-Encoding": "gzip", "Content-MD5": contentMD5(content)})
+		}, ERR_CHECKSUM_MISMATCH},
+		{"gzip with X-Checksum-Md5 of the decoded content", func() ErrCode {
+			sum := md5.Sum(content)
+			return put(gzipped.Bytes(), map[string]string{"Content-Encoding": "gzip", "X-Checksum-Md5": hex.EncodeToString(sum[:])})
+		}, ERR_OK},
+		{"invalid", func() ErrCode { return put(content, map[string]string{"Content-MD5": "abc"}) }, ERR_REQ_PARAMETER_CHECKSUM},
+		{"multipart of the whole body", func() ErrCode { return post(map[string]string{"Content-MD5": contentMD5(form.Bytes())}) }, ERR_OK},
+		{"multipart of the file", func() ErrCode { return post(map[string]string{"Content-MD5": contentMD5(content)}) }, ERR_CHECKSUM_MISMATCH},
+	}
+	for _, tt := range tests {
+		if got := tt.send(); got != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if got := readStored(t, "/raw.txt"); got != string(content) {
+		t.Errorf("stored %q", got)
+	}
+}
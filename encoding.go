@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"repo/httpgzip"
+)
+
+// encoded compresses the responses of h, the JSON API, with the coding the client prefers, like download.
+func encoded(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ew := httpgzip.NewWriter(w, r)
+		defer ew.Close()
+		h(ew, r, ps)
+	}
+}
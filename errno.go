@@ -3,17 +3,44 @@ package main
 type ErrCode int
 
 const (
-	ERR_OK                   ErrCode = 0
-	ERR_FILE_EXIST_DIR       ErrCode = 1
-	ERR_HTTP_GET_CONTENT     ErrCode = 10
-	ERR_REQ_PARAMETER_EXPIRE ErrCode = 20
-	ERR_REQ_PARAMETER_PATH   ErrCode = 21
-	ERR_UPDATE_DB            ErrCode = 30
-	ERR_READ_DB              ErrCode = 31
-	ERR_MKDIR                ErrCode = 40
-	ERR_OPEN_FILE            ErrCode = 50
-	ERR_FILE_NOT_IN_DB       ErrCode = 60
-	ERR_FILE_NOT_EXIST       ErrCode = 70
+	ERR_OK                     ErrCode = 0
+	ERR_FILE_EXIST_DIR         ErrCode = 1
+	ERR_HTTP_GET_CONTENT       ErrCode = 10
+	ERR_REQ_PARAMETER_EXPIRE   ErrCode = 20
+	ERR_REQ_PARAMETER_PATH     ErrCode = 21
+	ERR_REQ_PARAMETER_SIZE     ErrCode = 22
+	ERR_REQ_PARAMETER_CHECKSUM ErrCode = 23
+	ERR_REQ_PARAMETER_META     ErrCode = 24
+	ERR_REQ_PARAMETER_VERSION  ErrCode = 25
+	ERR_REQ_PARAMETER_SCOPE    ErrCode = 26
+	ERR_REQ_PARAMETER_METHOD   ErrCode = 27
+	ERR_UPDATE_DB              ErrCode = 30
+	ERR_READ_DB                ErrCode = 31
+	ERR_MKDIR                  ErrCode = 40
+	ERR_OPEN_FILE              ErrCode = 50
+	ERR_WRITE_FILE             ErrCode = 51
+	ERR_FILE_NOT_IN_DB         ErrCode = 60
+	ERR_VERSION_NOT_EXIST      ErrCode = 61
+	ERR_TOKEN_NOT_EXIST        ErrCode = 62
+	ERR_FILE_NOT_EXIST         ErrCode = 70
+	ERR_UPLOAD_NOT_EXIST       ErrCode = 80
+	ERR_UPLOAD_OFFSET          ErrCode = 81
+	ERR_UPLOAD_INCOMPLETE      ErrCode = 82
+	ERR_UPLOAD_TOO_LARGE       ErrCode = 83
+	ERR_UPLOAD_SIZE_EXCEEDED   ErrCode = 84
+	ERR_CHECKSUM_MISMATCH      ErrCode = 90
+	ERR_UNSUPPORTED_ENCODING   ErrCode = 100
+	ERR_CORRUPT_CONTENT        ErrCode = 101
+	ERR_CONTENT_TOO_LARGE      ErrCode = 102
+	ERR_COMPRESSION_RATIO      ErrCode = 103
+	ERR_ARCHIVE_FORMAT         ErrCode = 110
+	ERR_ARCHIVE_ENTRY          ErrCode = 111
+	ERR_ARCHIVE_ENTRIES        ErrCode = 112
+	ERR_UNAUTHORIZED           ErrCode = 120
+	ERR_FORBIDDEN              ErrCode = 121
+	ERR_SIGNATURE              ErrCode = 122
+	ERR_SIGN_NOT_CONFIGURED    ErrCode = 123
+	ERR_TOO_MANY_REQUESTS      ErrCode = 130
 )
 
 type ErrInfo struct {
@@ -33,6 +60,18 @@ func (e ErrCode) String() string {
 		return "request expired time format error"
 	case ERR_REQ_PARAMETER_PATH:
 		return "request path error"
+	case ERR_REQ_PARAMETER_SIZE:
+		return "request size format error"
+	case ERR_REQ_PARAMETER_CHECKSUM:
+		return "request checksum format error"
+	case ERR_REQ_PARAMETER_META:
+		return "request meta or tags format error"
+	case ERR_REQ_PARAMETER_VERSION:
+		return "request version format error"
+	case ERR_REQ_PARAMETER_SCOPE:
+		return "request scope format error"
+	case ERR_REQ_PARAMETER_METHOD:
+		return "request method error"
 	case ERR_UPDATE_DB:
 		return "update db error"
 	case ERR_READ_DB:
@@ -41,10 +80,52 @@ func (e ErrCode) String() string {
 		return "mkdir error"
 	case ERR_OPEN_FILE:
 		return "open file error"
+	case ERR_WRITE_FILE:
+		return "write file error"
 	case ERR_FILE_NOT_IN_DB:
 		return "file not exist in db"
+	case ERR_VERSION_NOT_EXIST:
+		return "version not exist"
+	case ERR_TOKEN_NOT_EXIST:
+		return "token not exist"
 	case ERR_FILE_NOT_EXIST:
 		return "file not exist"
+	case ERR_UPLOAD_NOT_EXIST:
+		return "upload session not exist"
+	case ERR_UPLOAD_OFFSET:
+		return "upload offset mismatch"
+	case ERR_UPLOAD_INCOMPLETE:
+		return "upload incomplete"
+	case ERR_UPLOAD_TOO_LARGE:
+		return "upload larger than allowed"
+	case ERR_UPLOAD_SIZE_EXCEEDED:
+		return "chunk beyond declared size"
+	case ERR_CHECKSUM_MISMATCH:
+		return "checksum mismatch"
+	case ERR_UNSUPPORTED_ENCODING:
+		return "unsupported content encoding"
+	case ERR_CORRUPT_CONTENT:
+		return "corrupt encoded content"
+	case ERR_CONTENT_TOO_LARGE:
+		return "decoded content too large"
+	case ERR_COMPRESSION_RATIO:
+		return "compression ratio too high"
+	case ERR_ARCHIVE_FORMAT:
+		return "unknown archive format"
+	case ERR_ARCHIVE_ENTRY:
+		return "archive entry is not a regular file under dest"
+	case ERR_ARCHIVE_ENTRIES:
+		return "archive has too many entries"
+	case ERR_UNAUTHORIZED:
+		return "missing or invalid token"
+	case ERR_FORBIDDEN:
+		return "token not allowed on path"
+	case ERR_SIGNATURE:
+		return "invalid or expired signature"
+	case ERR_SIGN_NOT_CONFIGURED:
+		return "url signing not configured"
+	case ERR_TOO_MANY_REQUESTS:
+		return "too many requests"
 	default:
 		return "unknown error"
 	}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"repo/log"
+	"strings"
+	"time"
+)
+
+// NEVER_EXPIRE is the expiredTime or expiredAt value of a file which is never removed by expiry.
+const NEVER_EXPIRE = "never"
+
+// expiry is when a stored file expires: duration after it is stored, at a fixed time, or never.
+type expiry struct {
+	duration time.Duration
+	at       *time.Time
+	never    bool
+}
+
+// parseExpiry parses expiredTime, a duration or "never", and expiredAt, an RFC3339 time or "never".
+// At most one of them may be set, defaultTime is used as expiredTime if neither is.
+func parseExpiry(expiredTime, expiredAt, defaultTime string) (expiry, error) {
+	if expiredTime != "" && expiredAt != "" {
+		return expiry{}, fmt.Errorf("both expiredTime and expiredAt are set")
+	}
+	if expiredAt != "" {
+		if strings.ToLower(expiredAt) == NEVER_EXPIRE {
+			return expiry{never: true}, nil
+		}
+		at, err := time.Parse(time.RFC3339, expiredAt)
+		if err != nil {
+			return expiry{}, err
+		}
+		return expiry{at: &at}, nil
+	}
+	if expiredTime == "" {
+		expiredTime = defaultTime
+	}
+	if strings.ToLower(expiredTime) == NEVER_EXPIRE {
+		return expiry{never: true}, nil
+	}
+	duration, err := time.ParseDuration(expiredTime)
+	if err != nil {
+		return expiry{}, err
+	}
+	return expiry{duration: duration}, nil
+}
+
+// ExpiredTime returns the ExpiredTime of a file stored at now, nil if it never expires.
+func (e expiry) ExpiredTime(now time.Time) *time.Time {
+	switch {
+	case e.never:
+		return nil
+	case e.at != nil:
+		at := *e.at
+		return &at
+	}
+	expiredTime := now.Add(e.duration)
+	return &expiredTime
+}
+
+// ExpireResponseInfo is the response of changing the expiry of files.
+type ExpireResponseInfo struct {
+	ErrInfo
+	NumUpdatedFiles int
+	UpdatedFiles    map[string]*FileInfo
+}
+
+// setExpiredTime writes expiredTime into the records of files, in one transaction. A record which
+// is gone since files was read is dropped from files, the others are replaced by what was written.
+func setExpiredTime(files map[string]*FileInfo, expiredTime *time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileInfo"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		for k := range files {
+			v := b.Get([]byte(k))
+			if v == nil {
+				delete(files, k)
+				continue
+			}
+			fileInfo := &FileInfo{}
+			if err := json.Unmarshal(v, fileInfo); err != nil {
+				return err
+			}
+			fileInfo.ExpiredTime = expiredTime
+			encoded, err := json.Marshal(fileInfo)
+			if err != nil {
+				return err
+			}
+			log.Debugf("Write DB: %s: %s", k, string(encoded))
+			if err := b.Put([]byte(k), encoded); err != nil {
+				return err
+			}
+			files[k] = fileInfo
+		}
+		return nil
+	})
+}
+
+/*
+Change the expiry of a stored file, or with recursive=true of every file under a directory, without uploading it again
+expiredTime is a duration from now, expiredAt is an RFC3339 time, either of them may be "never"
+curl -X PATCH -F expiredTime=72h "http://localhost:50010/r/files/jianwang/bolt.txt"
+curl -X PATCH -F expiredAt=2018-01-01T00:00:00+08:00 -F recursive=true "http://localhost:50010/r/files/jianwang"
+curl -X PATCH -F expiredTime=never "http://localhost:50010/r/files/release/app.tar.gz"
+Return value:
+{"Status":0,"Msg":"OK","NumUpdatedFiles":1,"UpdatedFiles":{"/jianwang/bolt.txt":{"CreateTime":"...","Md5":"...","ExpiredTime":"...","DownloadPath":"..."}}}
+*/
+func updateExpiry(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	reqPath := ps.ByName("filepath") // confined
+	r.ParseMultipartForm(32 << 20)
+	expiredTime, expiredAt := valuesGetDefault(r.Form, "expiredTime", ""), valuesGetDefault(r.Form, "expiredAt", "")
+	if expiredTime == "" && expiredAt == "" {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_EXPIRE))
+		return
+	}
+	e, err := parseExpiry(expiredTime, expiredAt, "")
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_EXPIRE))
+		return
+	}
+	recursive := valuesGetDefault(r.Form, "recursive", "false")
+	files, err := getFilesUnder(reqPath, strings.ToLower(recursive) == "true" || recursive == "1")
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	if len(files) == 0 {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_NOT_IN_DB))
+		return
+	}
+	if err := setExpiredTime(files, e.ExpiredTime(time.Now())); err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_UPDATE_DB))
+		return
+	}
+	for k, fileInfo := range files {
+		fileInfo.DownloadPath = downloadPath(r, k, nil)
+	}
+	log.Infof("expire %s: %d files, expiredTime: %s, expiredAt: %s", reqPath, len(files), expiredTime, expiredAt)
+	json.NewEncoder(w).Encode(ExpireResponseInfo{
+		ErrInfo:         MakeErrInfo(ERR_OK),
+		NumUpdatedFiles: len(files),
+		UpdatedFiles:    files,
+	})
+}
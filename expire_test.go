@@ -0,0 +1,156 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUpdateExpiry(t *testing.T) {
+	testServer(t)
+	for _, reqPath := range []string{"/team/a.txt", "/team/v1/b.txt", "/teams/c.txt"} {
+		storeFile(t, reqPath, reqPath, url.Values{"expiredTime": {"1h"}})
+	}
+	expire := func(reqPath string, fields url.Values) ExpireResponseInfo {
+		var resp ExpireResponseInfo
+		decodeJSON(t, call(updateExpiry, formRequest("PATCH", "/r/files"+reqPath, fields), httprouter.Param{Key: "filepath", Value: reqPath}), &resp)
+		return resp
+	}
+	expiredTime := func(reqPath string) *time.Time {
+		fileInfo, err := getFileInfo(reqPath)
+		if err != nil || fileInfo == nil {
+			t.Fatalf("%s: %+v, %v", reqPath, fileInfo, err)
+		}
+		return fileInfo.ExpiredTime
+	}
+
+	before := time.Now()
+	resp := expire("/team/a.txt", url.Values{"expiredTime": {"72h"}})
+	if resp.Status != ERR_OK || resp.NumUpdatedFiles != 1 || resp.UpdatedFiles["/team/a.txt"] == nil {
+		t.Fatalf("expiredTime: %+v", resp)
+	}
+	if e := expiredTime("/team/a.txt"); e == nil || e.Before(before.Add(72*time.Hour)) || e.After(time.Now().Add(72*time.Hour)) {
+		t.Errorf("ExpiredTime %v", e)
+	}
+	if resp.UpdatedFiles["/team/a.txt"].DownloadPath == "" {
+		t.Error("no DownloadPath")
+	}
+	// a directory is updated only with recursive
+	if resp := expire("/team", url.Values{"expiredTime": {"2h"}}); resp.Status != ERR_FILE_NOT_IN_DB {
+		t.Errorf("a directory: %+v", resp.ErrInfo)
+	}
+	resp = expire("/team", url.Values{"expiredAt": {"2030-01-01T00:00:00Z"}, "recursive": {"true"}})
+	if resp.Status != ERR_OK || resp.NumUpdatedFiles != 2 {
+		t.Fatalf("recursive: %+v", resp)
+	}
+	at := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, reqPath := range []string{"/team/a.txt", "/team/v1/b.txt"} {
+		if e := expiredTime(reqPath); e == nil || !e.Equal(at) {
+			t.Errorf("%s: ExpiredTime %v", reqPath, e)
+		}
+	}
+	if e := expiredTime("/teams/c.txt"); e == nil || e.After(time.Now().Add(time.Hour)) {
+		t.Errorf("/teams/c.txt is updated: %v", e)
+	}
+	if resp := expire("/team/v1/b.txt", url.Values{"expiredTime": {"never"}}); resp.Status != ERR_OK || expiredTime("/team/v1/b.txt") != nil {
+		t.Errorf("never: %+v", resp)
+	}
+
+	for _, tt := range []struct {
+		reqPath string
+		fields  url.Values
+		want    ErrCode
+	}{
+		{"/team/a.txt", url.Values{}, ERR_REQ_PARAMETER_EXPIRE},
+		{"/team/a.txt", url.Values{"expiredTime": {"soon"}}, ERR_REQ_PARAMETER_EXPIRE},
+		{"/team/a.txt", url.Values{"expiredAt": {"2030-01-01"}}, ERR_REQ_PARAMETER_EXPIRE},
+		{"/team/a.txt", url.Values{"expiredTime": {"1h"}, "expiredAt": {"never"}}, ERR_REQ_PARAMETER_EXPIRE},
+		{"/team/none.txt", url.Values{"expiredTime": {"1h"}}, ERR_FILE_NOT_IN_DB},
+	} {
+		if resp := expire(tt.reqPath, tt.fields); resp.Status != tt.want {
+			t.Errorf("%s %v: %+v, want %d", tt.reqPath, tt.fields, resp.ErrInfo, tt.want)
+		}
+	}
+	if e := expiredTime("/team/a.txt"); e == nil || !e.Equal(at) {
+		t.Errorf("a rejected request changed ExpiredTime to %v", e)
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := time.Date(2030, 1, 1, 8, 0, 0, 0, time.FixedZone("", 8*3600))
+	tests := []struct {
+		expiredTime, expiredAt, defaultTime string
+		want                                *time.Time // ExpiredTime of a file stored at now
+		ok                                  bool
+	}{
+		{"2h", "", "1h", timePtr(now.Add(2 * time.Hour)), true},
+		{"", "", "1h", timePtr(now.Add(time.Hour)), true},
+		{"never", "", "1h", nil, true},
+		{"NEVER", "", "", nil, true},
+		{"", "", "never", nil, true},
+		{"", "2030-01-01T08:00:00+08:00", "1h", &at, true},
+		{"", "never", "1h", nil, true},
+		{"1h", "2030-01-01T08:00:00+08:00", "", nil, false},
+		{"soon", "", "", nil, false},
+		{"", "2030-01-01", "", nil, false},
+		{"", "", "", nil, false},
+	}
+	for _, tt := range tests {
+		e, err := parseExpiry(tt.expiredTime, tt.expiredAt, tt.defaultTime)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseExpiry(%q, %q, %q): %v", tt.expiredTime, tt.expiredAt, tt.defaultTime, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		got := e.ExpiredTime(now)
+		if (got == nil) != (tt.want == nil) || got != nil && !got.Equal(*tt.want) {
+			t.Errorf("parseExpiry(%q, %q, %q) expires at %v, want %v", tt.expiredTime, tt.expiredAt, tt.defaultTime, got, tt.want)
+		}
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestCleanExpired(t *testing.T) {
+	testServer(t)
+	storeFile(t, "/old/a.txt", "expired", url.Values{"expiredTime": {"1h"}})
+	storeFile(t, "/old/b.txt", "expired at", url.Values{"expiredAt": {"2030-01-01T00:00:00Z"}})
+	storeFile(t, "/kept/c.txt", "never", url.Values{"expiredTime": {"never"}})
+	storeFile(t, "/kept/d.txt", "later", url.Values{"expiredTime": {"1h"}})
+	past := time.Now().Add(-time.Minute)
+	if err := setExpiredTime(map[string]*FileInfo{"/old/a.txt": nil, "/old/b.txt": nil}, &past); err != nil {
+		t.Fatal(err)
+	}
+	var resp DeleteResponseInfo
+	decodeJSON(t, call(clean, formRequest("POST", "/r/clean", nil)), &resp)
+	if resp.Status != ERR_OK || resp.NumDeletedFiles != 2 || resp.DeletedFiles["/old/a.txt"] == nil || resp.DeletedFiles["/old/b.txt"] == nil {
+		t.Fatalf("clean: %+v", resp)
+	}
+	for _, reqPath := range []string{"/old/a.txt", "/old/b.txt"} {
+		if fileInfo, _ := getFileInfo(reqPath); fileInfo != nil || readStored(t, reqPath) != "" {
+			t.Errorf("%s is kept", reqPath)
+		}
+	}
+	for reqPath, content := range map[string]string{"/kept/c.txt": "never", "/kept/d.txt": "later"} {
+		if fileInfo, _ := getFileInfo(reqPath); fileInfo == nil || readStored(t, reqPath) != content {
+			t.Errorf("%s is removed", reqPath)
+		}
+	}
+	// a file which never expires is never returned by getExpiredFiles
+	future := time.Now().Add(100 * 365 * 24 * time.Hour)
+	if err := setExpiredTime(map[string]*FileInfo{"/kept/d.txt": nil}, &future); err != nil {
+		t.Fatal(err)
+	}
+	if files := getExpiredFiles(); len(files) != 0 {
+		t.Errorf("expired: %v", files)
+	}
+	if fileInfo, _ := getFileInfo("/kept/c.txt"); fileInfo.Expired(future.Add(time.Hour)) {
+		t.Error("a file which never expires has expired")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"repo/log"
+	"strings"
+	"time"
+)
+
+// declaredContentType returns the Content-Type declared by the client, clients send
+// application/octet-stream or a form type when they don't know it, so those are ignored.
+func declaredContentType(v string) string {
+	mediaType, _, err := mime.ParseMediaType(v)
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "application/octet-stream", "application/x-www-form-urlencoded", "multipart/form-data":
+		return ""
+	}
+	return v
+}
+
+// declaredFileName returns the filename parameter of a Content-Disposition header.
+func declaredFileName(v string) string {
+	_, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return ""
+	}
+	return cleanFileName(params["filename"])
+}
+
+// cleanFileName strips the directories a client may send with a filename.
+func cleanFileName(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == "/" || !validHeaderValue(name) {
+		return ""
+	}
+	return name
+}
+
+// detectContentType returns declared if it is set, otherwise the type of the extension of name,
+// otherwise it sniffs the first bytes of the file at localPath. Extensions mapped to
+// application/octet-stream, like .bin, are sniffed as well.
+func detectContentType(localPath, name, declared string) (string, error) {
+	if declared != "" {
+		return declared, nil
+	}
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" && declaredContentType(ctype) != "" {
+		return ctype, nil
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var buf [512]byte
+	n, err := io.ReadFull(f, buf[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// remoteHost returns the address of the client of r without its port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// newFileInfo builds the FileInfo of the content staged at stagePath, which is going to be stored at reqPath.
+func newFileInfo(reqPath, stagePath string, digests digester, opts uploadOptions) (*FileInfo, error) {
+	st, err := os.Stat(stagePath)
+	if err != nil {
+		return nil, err
+	}
+	contentType, err := detectContentType(stagePath, reqPath, opts.contentType)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &FileInfo{
+		CreateTime:  now,
+		Md5:         digests.Md5(),
+		Digests:     digests.Digests(),
+		Size:        st.Size(),
+		ContentType: contentType,
+		FileName:    opts.fileName,
+		Uploader:    opts.uploader,
+		Meta:        opts.meta,
+		Tags:        opts.tags,
+		ExpiredTime: opts.expiry.ExpiredTime(now),
+	}, nil
+}
+
+// backfillFileInfo fills in Size and ContentType of a record written before they were recorded,
+// from the file on disk. It runs when info or download reads such a record, so old records are
+// backfilled lazily. The record is only rewritten if it has not been replaced meanwhile.
+func backfillFileInfo(reqPath string, fileInfo *FileInfo) {
+	localPath := path.Join(svr.dataDir, reqPath)
+	st, err := os.Stat(localPath)
+	if err != nil {
+		log.Warnf("backfill %s: %v", reqPath, err)
+		return
+	}
+	contentType, err := detectContentType(localPath, reqPath, "")
+	if err != nil {
+		log.Warnf("backfill %s: %v", reqPath, err)
+		return
+	}
+	fileInfo.Size = st.Size()
+	fileInfo.ContentType = contentType
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileInfo"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		v := b.Get([]byte(reqPath))
+		if v == nil {
+			return nil
+		}
+		current := &FileInfo{}
+		if err := json.Unmarshal(v, current); err != nil {
+			return err
+		}
+		if current.ContentType != "" || current.Md5 != fileInfo.Md5 || !current.CreateTime.Equal(fileInfo.CreateTime) {
+			return nil
+		}
+		current.Size = fileInfo.Size
+		current.ContentType = fileInfo.ContentType
+		encoded, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+		log.Debugf("Backfill DB: %s: %s", reqPath, string(encoded))
+		return b.Put([]byte(reqPath), encoded)
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackfillFileInfo(t *testing.T) {
+	testServer(t)
+	content := "<html><body>old</body></html>"
+	// records written before Size and ContentType were recorded
+	for _, reqPath := range []string{"/old/index.html", "/old/page.html"} {
+		localPath := filepath.Join(svr.dataDir, reqPath)
+		os.MkdirAll(filepath.Dir(localPath), 0755)
+		if err := ioutil.WriteFile(localPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := putFileInfo(reqPath, &FileInfo{CreateTime: time.Now(), Md5: "0123"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backfilled := func(reqPath string) bool {
+		fileInfo, err := getFileInfo(reqPath)
+		if err != nil || fileInfo == nil {
+			t.Fatalf("%s: %+v, %v", reqPath, fileInfo, err)
+		}
+		return fileInfo.Size == int64(len(content)) && strings.HasPrefix(fileInfo.ContentType, "text/html")
+	}
+
+	var resp FileInfoResponse
+	decodeJSON(t, call(info, httptest.NewRequest("GET", "/r/info/old/index.html", nil), httprouter.Param{Key: "filepath", Value: "/old/index.html"}), &resp)
+	if resp.Status != ERR_OK || resp.File.Size != int64(len(content)) || !strings.HasPrefix(resp.File.ContentType, "text/html") {
+		t.Errorf("info: %+v", resp)
+	}
+	if !backfilled("/old/index.html") {
+		t.Error("info does not backfill the record")
+	}
+	// a record is backfilled when it is read, not before
+	if backfilled("/old/page.html") {
+		t.Fatal("backfilled before it is read")
+	}
+	w := call(download, httptest.NewRequest("GET", "/r/download/old/page.html", nil), httprouter.Param{Key: "filepath", Value: "/old/page.html"})
+	if w.Body.String() != content || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("download: %q %v", w.Body.String(), w.Header())
+	}
+	if !backfilled("/old/page.html") {
+		t.Error("download does not backfill the record")
+	}
+}
@@ -2,23 +2,30 @@ package httpgzip
 
 import (
 	"bytes"
-	"compress/gzip"
-	"fmt"
-	"golang.org/x/net/http/httpguts"
 	"io"
 	"mime"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 // GzipByter is implemented by compressed files for
 // efficient direct access to the internal compressed bytes.
 type GzipByter interface {
-	// GzipBytes returns gzip compressed contents of the file.
+	// GzipBytes returns gzip compressed contents of the file,
+	// nil if they are not available after all.
 	GzipBytes() []byte
 }
 
+// GzipFiler is implemented by files which keep their gzip compressed contents in another file,
+// which is served from there rather than read into memory.
+type GzipFiler interface {
+	// GzipFile opens the gzip compressed contents of the file,
+	// nil if they are not available after all. The caller closes it.
+	GzipFile() http.File
+}
+
 // NotWorthGzipCompressing is implemented by files that were determined
 // not to be worth gzip compressing (the file size did not decrease as a result).
 type NotWorthGzipCompressing interface {
@@ -27,28 +34,40 @@ type NotWorthGzipCompressing interface {
 	NotWorthGzipCompressing()
 }
 
-// ServeContent is like http.ServeContent, except it applies gzip compression.
-// It's aware of GzipByter and NotWorthGzipCompressing interfaces, and uses them
-// to improve performance when the provided content implements them. Otherwise,
-// it applies gzip compression on the fly, if it's found to be beneficial.
+// MaxBufferedSize is the largest content which is compressed in memory before it is sent,
+// so that it is served with Content-Length and Range support, and only if compression pays off.
+// Larger content is compressed on the fly and sent chunked.
+var MaxBufferedSize int64 = 1 << 20
+
+// ServeContent is like http.ServeContent, except it applies the content coding the client
+// prefers of Encodings, weighing the q-values of its Accept-Encoding. It's aware of GzipByter,
+// GzipFiler and NotWorthGzipCompressing interfaces, and uses them to improve performance when
+// the provided content implements them. Otherwise, it compresses on the fly, if it's found to be beneficial.
+//
+// An ETag set by the caller describes the uncompressed content, compressed responses carry
+// a variant of it. Conditional GET and HEAD requests are answered with 304 before anything
+// is compressed. Every response, 304 ones too, gets Vary: Accept-Encoding. Range requests,
+// compressed types and files not worth compressing are served without coding; whenever a
+// response goes without coding, a client which excludes identity gets 406.
 func ServeContent(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, content io.ReadSeeker) {
-	// If client doesn't accept gzip encoding, serve without compression.
-	if !httpguts.HeaderValuesContainsToken(req.Header["Accept-Encoding"], "gzip") {
-		http.ServeContent(w, req, name, modTime, content)
-		return
-	}
+	// Every response varies by Accept-Encoding, if only by 406 to a client which excludes identity.
+	addVary(w.Header())
 
-	// If the file is not worth gzip compressing, serve it as is.
+	// If the file is not worth compressing, serve it as is, to the clients which accept that.
 	if _, ok := content.(NotWorthGzipCompressing); ok {
-		http.ServeContent(w, req, name, modTime, content)
+		if notModified(w, req, modTime) {
+			return
+		}
+		serveIdentity(w, req, name, modTime, content)
 		return
 	}
 
 	// The following cases involve compression, so we want to detect the Content-Type eagerly,
 	// before passing it off to http.ServeContent. It's because http.ServeContent won't be able
-	// to easily detect the original content type after content has been gzip compressed.
-	// We do this even for the last case that serves uncompressed data so that it doesn't
-	// have to do duplicate work.
+	// to easily detect the original content type after content has been compressed.
+	// We do this even for the cases that serve uncompressed data so that it doesn't
+	// have to do duplicate work, and before the 304 check, which needs to know whether
+	// the response varies by Accept-Encoding.
 	_, haveType := w.Header()["Content-Type"]
 	if !haveType {
 		ctype := mime.TypeByExtension(filepath.Ext(name))
@@ -66,40 +85,216 @@ func ServeContent(w http.ResponseWriter, req *http.Request, name string, modTime
 		w.Header().Set("Content-Type", ctype)
 	}
 
-	// If there are gzip encoded bytes available, use them directly.
-	if gzipFile, ok := content.(GzipByter); ok {
-		w.Header().Set("Content-Encoding", "gzip")
-		http.ServeContent(w, req, name, modTime, bytes.NewReader(gzipFile.GzipBytes()))
+	if notModified(w, req, modTime) {
+		return
+	}
+	// Compressed content is served as is, to the clients which accept that.
+	if IsCompressedType(w.Header().Get("Content-Type")) {
+		serveIdentity(w, req, name, modTime, content)
+		return
+	}
+
+	// gzip encoded contents at hand are preferred to the codings the client weighs equally.
+	gzipByter, haveGzipBytes := content.(GzipByter)
+	gzipFiler, haveGzipFile := content.(GzipFiler)
+	haveGzip := haveGzipBytes || haveGzipFile
+	offered := Encodings
+	if haveGzip {
+		offered = append([]string{"gzip"}, Encodings...)
+	}
+	coding := Negotiate(req, offered...)
+	// Ranges are taken of the content as is, whatever its size: the encoded bytes depend on the
+	// encoder, a range of one response would not fit the next. A client which excludes identity gets 406.
+	if coding != "" && req.Header.Get("Range") != "" {
+		coding = "identity"
+	}
+	switch coding {
+	case "":
+		http.Error(w, "no acceptable content coding", http.StatusNotAcceptable)
+		return
+	case "identity":
+		serveIdentity(w, req, name, modTime, content)
+		return
+	}
+
+	// If there are gzip encoded contents available, use them directly.
+	if haveGzipFile && coding == "gzip" {
+		if f := gzipFiler.GzipFile(); f != nil {
+			defer f.Close()
+			setEncoding(w.Header(), coding)
+			http.ServeContent(w, req, name, modTime, f)
+			return
+		}
+	}
+	if haveGzipBytes && coding == "gzip" {
+		if b := gzipByter.GzipBytes(); b != nil {
+			setEncoding(w.Header(), coding)
+			http.ServeContent(w, req, name, modTime, bytes.NewReader(b))
+			return
+		}
+	}
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		http.Error(w, "seeker can't seek", http.StatusInternalServerError)
+		return
+	}
+
+	// Large content is compressed while it is sent, unless the response needs preconditions,
+	// which only http.ServeContent checks.
+	if size > MaxBufferedSize {
+		if req.Header.Get("If-Match") != "" || req.Header.Get("If-Unmodified-Since") != "" {
+			serveIdentity(w, req, name, modTime, content)
+			return
+		}
+		streamEncoded(w, req, modTime, coding, content)
 		return
 	}
 
-	// Perform compression and serve gzip compressed bytes (if it's worth it).
-	if rs, err := gzipCompress(content); err == nil {
-		w.Header().Set("Content-Encoding", "gzip")
-		http.ServeContent(w, req, name, modTime, rs)
+	// Perform compression and serve compressed bytes, if it's worth it or the client wants no identity.
+	if b, n, err := compress(coding, content); err == nil && (int64(len(b)) < n || !acceptsIdentity(req)) {
+		setEncoding(w.Header(), coding)
+		http.ServeContent(w, req, name, modTime, bytes.NewReader(b))
 		return
 	}
 
 	// Serve as is.
+	serveIdentity(w, req, name, modTime, content)
+}
+
+// serveIdentity serves content without content coding, or 406 if the client excludes identity.
+func serveIdentity(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, content io.ReadSeeker) {
+	if !acceptsIdentity(req) {
+		http.Error(w, "no acceptable content coding", http.StatusNotAcceptable)
+		return
+	}
 	http.ServeContent(w, req, name, modTime, content)
 }
 
-// gzipCompress compresses input from r and returns it as an io.ReadSeeker.
-// It returns an error if compressed size is not smaller than uncompressed.
-func gzipCompress(r io.Reader) (io.ReadSeeker, error) {
+// setEncoding marks the response as encoded with coding. Digest headers set by the caller
+// describe the uncompressed content, they no longer match and are removed: Digest is of the
+// instance, and Repr-Digest (RFC 9530) of the representation data, which is the encoded bytes
+// once a content coding is applied. The ETag becomes the one of the encoded variant.
+func setEncoding(header http.Header, coding string) {
+	header.Set("Content-Encoding", coding)
+	header.Del("Digest")
+	header.Del("Repr-Digest")
+	if etag := header.Get("Etag"); etag != "" {
+		header.Set("Etag", encodedETag(etag, coding))
+	}
+}
+
+// notModified answers a conditional GET or HEAD request with 304 if If-None-Match matches the
+// ETag of the response or one of its encoded variants, or without If-None-Match, if the content
+// is not modified since If-Modified-Since. It reports whether it did.
+func notModified(w http.ResponseWriter, req *http.Request, modTime time.Time) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	etag := w.Header().Get("Etag")
+	matched := ""
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			// If-None-Match uses the weak comparison
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+				matched = etag
+				continue
+			}
+			for _, coding := range Encodings {
+				if variant := encodedETag(etag, coding); tag == strings.TrimPrefix(variant, "W/") {
+					matched = variant
+				}
+			}
+		}
+		if matched == "" {
+			return false
+		}
+	} else if ims := req.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		t, err := http.ParseTime(ims)
+		// the header has a resolution of seconds
+		if err != nil || modTime.Truncate(time.Second).After(t) {
+			return false
+		}
+	} else {
+		return false
+	}
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	if matched != "" {
+		h.Set("Etag", matched)
+	}
+	if !modTime.IsZero() {
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// streamEncoded sends content encoded with coding as it is read, without Content-Length.
+func streamEncoded(w http.ResponseWriter, req *http.Request, modTime time.Time, coding string, content io.Reader) {
+	setEncoding(w.Header(), coding)
+	w.Header().Del("Content-Length")
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+	if req.Method == "HEAD" {
+		return
+	}
+	enc, err := newEncoder(coding, w)
+	if err != nil {
+		return
+	}
+	if _, err := io.Copy(enc, content); err != nil {
+		// The status is sent already, the client sees a truncated stream.
+		return
+	}
+	enc.Close()
+}
+
+// IsCompressedType reports whether content of ctype is compressed already, so that gzip can't shrink it.
+func IsCompressedType(ctype string) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return true
+	}
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/zip", "application/zstd", "application/x-xz",
+		"application/x-bzip2", "application/x-7z-compressed", "application/x-rar-compressed", "application/java-archive":
+		return true
+	}
+	return false
+}
+
+// compress encodes input from r with coding, it returns the encoded bytes and the size of the input.
+func compress(coding string, r io.Reader) ([]byte, int64, error) {
 	var buf bytes.Buffer
-	gw := gzip.NewWriter(&buf)
-	n, err := io.Copy(gw, r)
+	enc, err := newEncoder(coding, &buf)
 	if err != nil {
-		// No need to gw.Close() here since we're discarding the result, and gzip.Writer.Close isn't needed for cleanup.
-		return nil, err
+		return nil, 0, err
 	}
-	err = gw.Close()
+	n, err := io.Copy(enc, r)
 	if err != nil {
-		return nil, err
+		// No need to enc.Close() here since we're discarding the result.
+		return nil, 0, err
 	}
-	if int64(buf.Len()) >= n {
-		return nil, fmt.Errorf("not worth gzip compressing: original size %v, compressed size %v", n, buf.Len())
+	err = enc.Close()
+	if err != nil {
+		return nil, 0, err
 	}
-	return bytes.NewReader(buf.Bytes()), nil
+	return buf.Bytes(), n, nil
 }
@@ -0,0 +1,165 @@
+package httpgzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve serves content named name to a GET request with header.
+func serve(name string, content []byte, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/"+name, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	ServeContent(w, req, name, time.Unix(1500000000, 0), bytes.NewReader(content))
+	return w
+}
+
+func TestServeContentRange(t *testing.T) {
+	defer func(size int64) { MaxBufferedSize = size }(MaxBufferedSize)
+	content := []byte(strings.Repeat("0123456789", 1000))
+	for _, maxSize := range []int64{1 << 20, 100} {
+		MaxBufferedSize = maxSize
+		for _, accept := range []string{"gzip", "br, zstd", "*"} {
+			w := serve("a.txt", content, map[string]string{"Accept-Encoding": accept, "Range": "bytes=10-19"})
+			if w.Code != http.StatusPartialContent || w.Body.String() != "0123456789" ||
+				w.Header().Get("Content-Encoding") != "" {
+				t.Errorf("Range with %q, MaxBufferedSize %d = %d %q, Content-Encoding %q",
+					accept, maxSize, w.Code, w.Body.String(), w.Header().Get("Content-Encoding"))
+			}
+		}
+		if w := serve("a.txt", content, map[string]string{"Accept-Encoding": "gzip"}); w.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("MaxBufferedSize %d: no gzip without Range", maxSize)
+		}
+	}
+}
+
+// gzipFile is content with its gzip compressed contents in the file gz.
+type gzipFile struct {
+	*bytes.Reader
+	gz string
+}
+
+func (f gzipFile) GzipFile() http.File {
+	gz, err := os.Open(f.gz)
+	if err != nil {
+		return nil
+	}
+	return gz
+}
+
+func TestServeContentGzipFile(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(content)
+	gw.Close()
+	gz := filepath.Join(t.TempDir(), "a.txt.gz")
+	if err := ioutil.WriteFile(gz, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	serveGzipFile := func(gz, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/a.txt", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		ServeContent(w, req, "a.txt", time.Unix(1500000000, 0), gzipFile{bytes.NewReader(content), gz})
+		return w
+	}
+	// the file is preferred to the codings the client weighs equally
+	w := serveGzipFile(gz, "zstd, br, gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || !bytes.Equal(w.Body.Bytes(), buf.Bytes()) {
+		t.Errorf("served %q, %d bytes, want the gzip file", w.Header().Get("Content-Encoding"), w.Body.Len())
+	}
+	if w := serveGzipFile(gz, "br"); w.Header().Get("Content-Encoding") != "br" {
+		t.Errorf("served %q to a br client", w.Header().Get("Content-Encoding"))
+	}
+	// without the file the content is compressed on the fly
+	w = serveGzipFile(gz+".missing", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("served %q without the gzip file", w.Header().Get("Content-Encoding"))
+	}
+	if r, err := gzip.NewReader(w.Body); err != nil {
+		t.Error(err)
+	} else if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("decoded %d bytes, %v", len(b), err)
+	}
+}
+
+// notWorthFile is content which gzip does not make smaller.
+type notWorthFile struct {
+	*bytes.Reader
+}
+
+func (notWorthFile) NotWorthGzipCompressing() {}
+
+func TestServeContentVary(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	lastModified := time.Unix(1500000000, 0).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name    string
+		content io.ReadSeeker
+		header  map[string]string
+		code    int
+		vary    bool
+	}{
+		{"a.txt", bytes.NewReader(content), map[string]string{"Accept-Encoding": "gzip"}, http.StatusOK, true},
+		{"a.txt", bytes.NewReader(content), map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified, true},
+		{"a.txt", bytes.NewReader(content), map[string]string{"Accept-Encoding": "*;q=0"}, http.StatusNotAcceptable, true},
+		{"a.zip", bytes.NewReader(content), map[string]string{"Accept-Encoding": "gzip"}, http.StatusOK, true},
+		{"a.zip", bytes.NewReader(content), map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified, true},
+		// a response without coding is refused to a client which excludes identity, whatever the reason
+		{"a.zip", bytes.NewReader(content), map[string]string{"Accept-Encoding": "gzip, identity;q=0"}, http.StatusNotAcceptable, true},
+		{"a.txt", bytes.NewReader(content), map[string]string{"Accept-Encoding": "gzip, identity;q=0", "Range": "bytes=10-19"}, http.StatusNotAcceptable, true},
+		{"a.txt", bytes.NewReader(content), map[string]string{"Accept-Encoding": "gzip, identity;q=0"}, http.StatusOK, true},
+		{"a.txt", notWorthFile{bytes.NewReader(content)}, map[string]string{"Accept-Encoding": "gzip"}, http.StatusOK, true},
+		{"a.txt", notWorthFile{bytes.NewReader(content)}, map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified, true},
+		{"a.txt", notWorthFile{bytes.NewReader(content)}, map[string]string{"Accept-Encoding": "identity;q=0"}, http.StatusNotAcceptable, true},
+		{"a.txt", notWorthFile{bytes.NewReader(content)}, map[string]string{"Accept-Encoding": "gzip, *;q=0"}, http.StatusNotAcceptable, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/"+tt.name, nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		ServeContent(w, req, tt.name, time.Unix(1500000000, 0), tt.content)
+		if vary := w.Header().Get("Vary") == "Accept-Encoding"; w.Code != tt.code || vary != tt.vary {
+			t.Errorf("%s %T with %v = %d, Vary %q, want %d, Vary %v",
+				tt.name, tt.content, tt.header, w.Code, w.Header().Get("Vary"), tt.code, tt.vary)
+		}
+		if tt.code == http.StatusOK && w.Body.Len() == 0 {
+			t.Errorf("%s %T with %v: empty body", tt.name, tt.content, tt.header)
+		}
+	}
+}
+
+func TestServeContentDigest(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	for _, accept := range []string{"", "gzip"} {
+		req := httptest.NewRequest("GET", "/a.txt", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		w.Header().Set("Digest", "md5=abc")
+		w.Header().Set("Repr-Digest", "md5=:abc:")
+		w.Header().Set("Etag", `"abc"`)
+		ServeContent(w, req, "a.txt", time.Unix(1500000000, 0), bytes.NewReader(content))
+		// the digests of the stored content don't describe the encoded representation
+		encoded := w.Header().Get("Content-Encoding") != ""
+		if encoded != (accept != "") || (w.Header().Get("Digest") != "") == encoded || (w.Header().Get("Repr-Digest") != "") == encoded {
+			t.Errorf("Accept-Encoding %q: %v", accept, w.Header())
+		}
+		if want := map[bool]string{false: `"abc"`, true: `"abc-gzip"`}[encoded]; w.Header().Get("Etag") != want {
+			t.Errorf("Accept-Encoding %q: ETag %s, want %s", accept, w.Header().Get("Etag"), want)
+		}
+	}
+}
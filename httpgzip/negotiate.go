@@ -0,0 +1,144 @@
+package httpgzip
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Encodings are the content codings the server produces, in its order of preference
+// among the ones a client weighs equally.
+var Encodings = []string{"zstd", "br", "gzip", "deflate"}
+
+// encoders create a compressing writer of each coding of Encodings.
+var encoders = map[string]func(io.Writer) (io.WriteCloser, error){
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+	// HTTP deflate is the zlib format
+	"deflate": func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriter(w), nil
+	},
+	"br": func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriter(w), nil
+	},
+	"zstd": func(w io.Writer) (io.WriteCloser, error) {
+		// encode in the goroutine of the response, like the other codings do
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	},
+}
+
+// acceptEncoding parses the Accept-Encoding header of req into q-values by coding,
+// "*" stands for the codings which are not listed.
+func acceptEncoding(req *http.Request) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, v := range req.Header["Accept-Encoding"] {
+		for _, item := range strings.Split(v, ",") {
+			params := strings.Split(item, ";")
+			coding := strings.ToLower(strings.TrimSpace(params[0]))
+			if coding == "" {
+				continue
+			}
+			q := 1.0
+			for _, param := range params[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+					if f, err := strconv.ParseFloat(kv[1], 64); err == nil && f >= 0 && f <= 1 {
+						q = f
+					} else {
+						q = 0
+					}
+				}
+			}
+			if coding == "x-gzip" {
+				coding = "gzip"
+			}
+			accepted[coding] = q
+		}
+	}
+	return accepted
+}
+
+// qValue returns the q-value of coding in accepted. identity is acceptable unless it is
+// excluded, by itself or by "*".
+func qValue(accepted map[string]float64, coding string) float64 {
+	if q, ok := accepted[coding]; ok {
+		return q
+	}
+	if q, ok := accepted["*"]; ok {
+		return q
+	}
+	if coding == "identity" {
+		return 1
+	}
+	return 0
+}
+
+// Negotiate returns the coding of offered which the client of req prefers, the first one of
+// offered if the client weighs several equally. It returns "identity" if the client prefers
+// no coding, or none of offered is acceptable, and "" if not even identity is acceptable.
+func Negotiate(req *http.Request, offered ...string) string {
+	accepted := acceptEncoding(req)
+	best, bestQ := "", 0.0
+	for _, coding := range offered {
+		if q := qValue(accepted, coding); q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	if best == "" {
+		if qValue(accepted, "identity") > 0 {
+			return "identity"
+		}
+		return ""
+	}
+	// identity is implicitly acceptable, it only beats a coding the client weighs less explicitly
+	q, explicit := accepted["identity"]
+	if !explicit {
+		q, explicit = accepted["*"]
+	}
+	if explicit && q > bestQ {
+		return "identity"
+	}
+	return best
+}
+
+// AcceptsGzip reports whether the client of req accepts gzip encoding.
+func AcceptsGzip(req *http.Request) bool {
+	return qValue(acceptEncoding(req), "gzip") > 0
+}
+
+// acceptsIdentity reports whether the client of req accepts content without coding.
+func acceptsIdentity(req *http.Request) bool {
+	return qValue(acceptEncoding(req), "identity") > 0
+}
+
+// newEncoder returns a writer which compresses into w with coding.
+func newEncoder(coding string, w io.Writer) (io.WriteCloser, error) {
+	return encoders[coding](w)
+}
+
+// encodedETag returns the ETag of the variant of the content with etag which is encoded
+// with coding, "abc" becomes "abc-gzip".
+func encodedETag(etag, coding string) string {
+	if coding == "identity" || !strings.HasSuffix(etag, `"`) || strings.HasSuffix(etag, `-`+coding+`"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + `-` + coding + `"`
+}
+
+// addVary adds Accept-Encoding to the Vary header of h, unless it is there.
+func addVary(h http.Header) {
+	for _, v := range h["Vary"] {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
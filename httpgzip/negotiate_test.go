@@ -0,0 +1,69 @@
+package httpgzip
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]float64
+	}{
+		{"", map[string]float64{}},
+		{"gzip, deflate", map[string]float64{"gzip": 1, "deflate": 1}},
+		{"GZIP;Q=0.5, br;q=1.0", map[string]float64{"gzip": 0.5, "br": 1}},
+		{"x-gzip", map[string]float64{"gzip": 1}},
+		{"*;q=0", map[string]float64{"*": 0}},
+		{"identity;q=0, zstd", map[string]float64{"identity": 0, "zstd": 1}},
+		// an invalid q-value makes the coding unacceptable
+		{"gzip;q=2, br;q=x, deflate;q=-1", map[string]float64{"gzip": 0, "br": 0, "deflate": 0}},
+		{" , gzip ;level=9", map[string]float64{"gzip": 1}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptEncoding(req); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("acceptEncoding(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		header  string
+		offered []string
+		want    string
+	}{
+		{"", Encodings, "identity"},
+		{"gzip", Encodings, "gzip"},
+		{"x-gzip", Encodings, "gzip"},
+		{"gzip, deflate, br, zstd", Encodings, "zstd"},
+		{"gzip, br", []string{"gzip", "zstd", "br"}, "gzip"},
+		{"gzip;q=0.5, br;q=0.8", Encodings, "br"},
+		{"*", Encodings, "zstd"},
+		{"*;q=0.5, gzip", Encodings, "gzip"},
+		{"br;q=0, *", Encodings, "zstd"},
+		{"compress", Encodings, "identity"},
+		{"gzip;q=0", Encodings, "identity"},
+		{"*;q=0", Encodings, ""},
+		{"*;q=0, gzip", Encodings, "gzip"},
+		{"*;q=0, identity", Encodings, "identity"},
+		{"identity;q=0", Encodings, ""},
+		{"identity;q=0, br", Encodings, "br"},
+		{"identity;q=0, compress", Encodings, ""},
+		{"identity, gzip;q=0.5", Encodings, "identity"},
+		{"identity;q=0.5, gzip", Encodings, "gzip"},
+		{"gzip", nil, "identity"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			req.Header.Set("Accept-Encoding", tt.header)
+		}
+		if got := Negotiate(req, tt.offered...); got != tt.want {
+			t.Errorf("Negotiate(%q, %v) = %q, want %q", tt.header, tt.offered, got, tt.want)
+		}
+	}
+}
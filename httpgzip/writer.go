@@ -0,0 +1,131 @@
+package httpgzip
+
+import (
+	"io"
+	"net/http"
+)
+
+// MinEncodedSize is the smallest response body a Writer compresses, smaller ones don't pay off.
+var MinEncodedSize = 1024
+
+// Writer is an http.ResponseWriter which compresses the response with the coding the client
+// prefers of Encodings, if the response is compressible and large enough. It holds the start
+// of the body back until it knows, so Close must be called when the response is written.
+type Writer struct {
+	http.ResponseWriter
+	req     *http.Request
+	status  int
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser
+}
+
+// NewWriter returns a Writer of the response to req.
+func NewWriter(w http.ResponseWriter, req *http.Request) *Writer {
+	return &Writer{ResponseWriter: w, req: req}
+}
+
+// WriteHeader records the status, it is sent with the first bytes of the body.
+func (w *Writer) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < MinEncodedSize {
+			return len(p), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends what is written so far, encoded if it is decided to.
+func (w *Writer) Flush() {
+	if !w.decided {
+		w.decide()
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close sends the rest of the response and finishes its encoding.
+func (w *Writer) Close() error {
+	if !w.decided {
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.enc != nil {
+		return w.enc.Close()
+	}
+	return nil
+}
+
+// decide chooses the coding of the response by what is held back of its body, sends the header
+// and the held back bytes.
+func (w *Writer) decide() error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	h := w.Header()
+	if _, haveType := h["Content-Type"]; !haveType && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if w.compressible() {
+		addVary(h)
+		coding := Negotiate(w.req, Encodings...)
+		if coding != "" && coding != "identity" && (len(w.buf) >= MinEncodedSize || !acceptsIdentity(w.req)) {
+			enc, err := newEncoder(coding, w.ResponseWriter)
+			if err == nil {
+				setEncoding(h, coding)
+				h.Del("Content-Length")
+				w.enc = enc
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// compressible reports whether the coding of the response is up to the Writer: it has a body
+// which is neither encoded nor a range, nor compressed already.
+func (w *Writer) compressible() bool {
+	h := w.Header()
+	switch {
+	case w.req.Method == "HEAD", w.status < 200, w.status == http.StatusNoContent,
+		w.status == http.StatusNotModified, w.status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "", h.Get("Content-Range") != "":
+		return false
+	}
+	return !IsCompressedType(h.Get("Content-Type"))
+}
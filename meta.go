@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Limits of the metadata of a file, it is sent back as response headers.
+const (
+	MAX_META_ENTRIES = 64
+	MAX_META_VALUE   = 1024
+	MAX_TAGS         = 64
+	MAX_TAG_LENGTH   = 128
+)
+
+// validMetaKey reports whether key can be used in a header name, like git-sha or build_number.
+func validMetaKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue reports whether v can be sent as a header value.
+func validHeaderValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMeta collects the metadata of an upload from the X-Meta-<Key> headers and the meta-<key> fields
+// of values, and the tags from the X-Tags header and the tags fields, comma separated.
+// Keys are lower case, a field overrides a header of the same key.
+func parseMeta(header http.Header, values url.Values) (map[string]string, []string, error) {
+	meta := make(map[string]string)
+	set := func(key, v string) error {
+		key = strings.ToLower(key)
+		if !validMetaKey(key) {
+			return fmt.Errorf("invalid meta key: %q", key)
+		}
+		if len(v) > MAX_META_VALUE || !validHeaderValue(v) {
+			return fmt.Errorf("invalid meta value of %s", key)
+		}
+		meta[key] = v
+		return nil
+	}
+	for k, v := range header {
+		if strings.HasPrefix(k, "X-Meta-") && len(v) > 0 {
+			if err := set(k[len("X-Meta-"):], v[0]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	for k, v := range values {
+		if strings.HasPrefix(strings.ToLower(k), "meta-") && len(v) > 0 {
+			if err := set(k[len("meta-"):], v[0]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if len(meta) > MAX_META_ENTRIES {
+		return nil, nil, fmt.Errorf("too many meta entries: %d", len(meta))
+	}
+
+	tags := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, list := range append(header["X-Tags"], values["tags"]...) {
+		for _, tag := range strings.Split(list, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "" || seen[tag] {
+				continue
+			}
+			if len(tag) > MAX_TAG_LENGTH || !validHeaderValue(tag) {
+				return nil, nil, fmt.Errorf("invalid tag: %q", tag)
+			}
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > MAX_TAGS {
+		return nil, nil, fmt.Errorf("too many tags: %d", len(tags))
+	}
+	if len(meta) == 0 {
+		meta = nil
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+	return meta, tags, nil
+}
+
+// setMetaHeaders sends the metadata of fileInfo as X-Meta-<Key> response headers, and its tags as X-Tags.
+func setMetaHeaders(header http.Header, fileInfo *FileInfo) {
+	for k, v := range fileInfo.Meta {
+		header.Set("X-Meta-"+k, v)
+	}
+	if len(fileInfo.Tags) > 0 {
+		header.Set("X-Tags", strings.Join(fileInfo.Tags, ","))
+	}
+}
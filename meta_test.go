@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMeta(t *testing.T) {
+	many := url.Values{}
+	for i := 0; i <= MAX_META_ENTRIES; i++ {
+		many.Set("meta-k"+strings.Repeat("x", i), "v")
+	}
+	tests := []struct {
+		name   string
+		header http.Header
+		values url.Values
+		meta   map[string]string
+		tags   []string
+		ok     bool
+	}{
+		{"none", http.Header{}, url.Values{}, nil, nil, true},
+		{"header", http.Header{"X-Meta-Git-Sha": {"1a2b3c"}}, nil, map[string]string{"git-sha": "1a2b3c"}, nil, true},
+		{"field", nil, url.Values{"meta-Build_Number": {"42"}, "build": {"x"}}, map[string]string{"build_number": "42"}, nil, true},
+		{"field over header", http.Header{"X-Meta-Build": {"1"}}, url.Values{"meta-build": {"2"}}, map[string]string{"build": "2"}, nil, true},
+		{"tags", http.Header{"X-Tags": {"release, linux"}}, url.Values{"tags": {"linux,,amd64"}}, nil, []string{"release", "linux", "amd64"}, true},
+		{"bad key", http.Header{"X-Meta-Bad Key": {"x"}}, nil, nil, nil, false},
+		{"bad value", nil, url.Values{"meta-a": {"a\nb"}}, nil, nil, false},
+		{"long value", nil, url.Values{"meta-a": {strings.Repeat("v", MAX_META_VALUE+1)}}, nil, nil, false},
+		{"too many", nil, many, nil, nil, false},
+		{"long tag", nil, url.Values{"tags": {strings.Repeat("t", MAX_TAG_LENGTH+1)}}, nil, nil, false},
+		{"bad tag", http.Header{"X-Tags": {"a\x7f"}}, nil, nil, nil, false},
+	}
+	for _, tt := range tests {
+		meta, tags, err := parseMeta(tt.header, tt.values)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.ok && (!reflect.DeepEqual(meta, tt.meta) || !reflect.DeepEqual(tags, tt.tags)) {
+			t.Errorf("%s: %v %q, want %v %q", tt.name, meta, tags, tt.meta, tt.tags)
+		}
+	}
+}
+
+func TestMetaHeaders(t *testing.T) {
+	testServer(t)
+	r := httptest.NewRequest("PUT", "/r/upload/release/app.tgz?meta-build=42&tags=release,linux", strings.NewReader("app"))
+	r.Header.Set("X-Meta-Git-Sha", "1a2b3c")
+	var resp UploadResponseInfo
+	decodeJSON(t, call(uploadRaw, r, httprouter.Param{Key: "filepath", Value: "/release/app.tgz"}), &resp)
+	if resp.Status != ERR_OK || resp.File.Meta["git-sha"] != "1a2b3c" || resp.File.Meta["build"] != "42" {
+		t.Fatalf("upload: %+v", resp)
+	}
+	w := call(download, httptest.NewRequest("GET", "/r/download/release/app.tgz", nil), httprouter.Param{Key: "filepath", Value: "/release/app.tgz"})
+	for k, want := range map[string]string{"X-Meta-Git-Sha": "1a2b3c", "X-Meta-Build": "42", "X-Tags": "release,linux"} {
+		if got := w.Header().Get(k); got != want {
+			t.Errorf("%s: %q, want %q", k, got, want)
+		}
+	}
+	// the metadata goes with the file it describes
+	storeFile(t, "/release/app.tgz", "replaced", nil)
+	w = call(download, httptest.NewRequest("GET", "/r/download/release/app.tgz", nil), httprouter.Param{Key: "filepath", Value: "/release/app.tgz"})
+	if w.Header().Get("X-Meta-Build") != "" || w.Header().Get("X-Tags") != "" {
+		t.Errorf("metadata of the replaced file: %v", w.Header())
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"repo/log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clients idle longer than this are forgotten, with their stats
+const CLIENT_IDLE_TIME = 10 * time.Minute
+
+// bucket is a token bucket which refills at rate tokens per second up to burst.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate, burst float64, now time.Time) *bucket {
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// allow takes a token if there is one, otherwise it returns how long until there is.
+func (b *bucket) allow(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take takes n tokens, going into debt if there are not enough, and returns how long to wait for the debt.
+func (b *bucket) take(n int, now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// ClientStats is what the throttling did to one client since it became active.
+type ClientStats struct {
+	Client   string
+	Requests int64
+	Rejected int64
+	BytesIn  int64
+	BytesOut int64
+	// time its streams waited for bandwidth
+	ThrottledSeconds float64
+}
+
+// ThrottleStats is the throttling part of status.
+type ThrottleStats struct {
+	RequestsPerSecond float64
+	BytesPerSecond    int64
+	Rejected          int64
+	Clients           []ClientStats
+}
+
+type clientLimiter struct {
+	mu       sync.Mutex
+	requests *bucket
+	in, out  *bucket
+	lastSeen time.Time
+	stats    ClientStats
+}
+
+var limiters = struct {
+	sync.Mutex
+	m         map[string]*clientLimiter
+	lastPrune time.Time
+	rejected  int64
+}{m: make(map[string]*clientLimiter)}
+
+// clientKey is what a client is throttled by: its token, its client certificate or its address.
+// A token only counts if it exists, otherwise a client would get a new bucket with every made up one.
+func clientKey(r *http.Request) string {
+	if secret := requestSecret(r); secret != "" {
+		if token, err := lookupToken(secret); err != nil {
+			log.Error(err)
+		} else if token != nil {
+			return "token:" + token.ID
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	return "ip:" + remoteHost(r)
+}
+
+func getLimiter(key string, now time.Time) *clientLimiter {
+	limiters.Lock()
+	defer limiters.Unlock()
+	if now.Sub(limiters.lastPrune) > time.Minute {
+		for k, l := range limiters.m {
+			l.mu.Lock()
+			idle := now.Sub(l.lastSeen) > CLIENT_IDLE_TIME
+			l.mu.Unlock()
+			if idle {
+				delete(limiters.m, k)
+			}
+		}
+		limiters.lastPrune = now
+	}
+	l := limiters.m[key]
+	if l == nil {
+		l = &clientLimiter{lastSeen: now, stats: ClientStats{Client: key}}
+		if svr.rateLimit > 0 {
+			l.requests = newBucket(svr.rateLimit, math.Max(1, float64(svr.rateBurst)), now)
+		}
+		if svr.bandwidthLimit > 0 {
+			// a second of traffic may go at once
+			l.in = newBucket(float64(svr.bandwidthLimit), float64(svr.bandwidthLimit), now)
+			l.out = newBucket(float64(svr.bandwidthLimit), float64(svr.bandwidthLimit), now)
+		}
+		limiters.m[key] = l
+	}
+	return l
+}
+
+// wait takes n bytes from b and sleeps until they are paid for.
+func (l *clientLimiter) wait(b *bucket, n int, counter *int64) {
+	l.mu.Lock()
+	now := time.Now()
+	d := b.take(n, now)
+	*counter += int64(n)
+	l.stats.ThrottledSeconds += d.Seconds()
+	l.lastSeen = now
+	l.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	l *clientLimiter
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.l.wait(r.l.in, n, &r.l.stats.BytesIn)
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	l *clientLimiter
+}
+
+func (w throttledWriter) Write(p []byte) (int, error) {
+	// large writes are paid for in pieces, so the stream doesn't stall for long
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if max := int(svr.bandwidthLimit); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		w.l.wait(w.l.out, len(chunk), &w.l.stats.BytesOut)
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// throttled limits the requests per second of every client to -rateLimit, rejected ones get 429,
+// and the bytes per second of their request and response bodies to -bandwidthLimit.
+func throttled(h http.Handler) http.Handler {
+	if svr.rateLimit <= 0 && svr.bandwidthLimit <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		l := getLimiter(clientKey(r), now)
+		l.mu.Lock()
+		l.lastSeen = now
+		l.stats.Requests++
+		ok, retry := true, time.Duration(0)
+		if l.requests != nil {
+			ok, retry = l.requests.allow(now)
+		}
+		if !ok {
+			l.stats.Rejected++
+		}
+		key := l.stats.Client
+		l.mu.Unlock()
+		if !ok {
+			limiters.Lock()
+			limiters.rejected++
+			limiters.Unlock()
+			log.Warnf("%s: %s, From: %s, rate limit of %s", r.Method, r.URL.Path, r.RemoteAddr, key)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_TOO_MANY_REQUESTS))
+			return
+		}
+		if l.in != nil {
+			r.Body = throttledReader{r.Body, l}
+			w = throttledWriter{w, l}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// throttleStats returns the limits and the clients active lately, busiest first, nil without limits.
+func throttleStats() *ThrottleStats {
+	if svr.rateLimit <= 0 && svr.bandwidthLimit <= 0 {
+		return nil
+	}
+	limiters.Lock()
+	stats := &ThrottleStats{
+		RequestsPerSecond: svr.rateLimit,
+		BytesPerSecond:    svr.bandwidthLimit,
+		Rejected:          limiters.rejected,
+		Clients:           make([]ClientStats, 0, len(limiters.m)),
+	}
+	for _, l := range limiters.m {
+		l.mu.Lock()
+		stats.Clients = append(stats.Clients, l.stats)
+		l.mu.Unlock()
+	}
+	limiters.Unlock()
+	sort.Slice(stats.Clients, func(i, j int) bool { return stats.Clients[i].Requests > stats.Clients[j].Requests })
+	return stats
+}
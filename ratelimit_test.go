@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestThrottledByAddress(t *testing.T) {
+	testServer(t)
+	svr.rateLimit, svr.rateBurst = 0.001, 2
+	limiters.m, limiters.rejected = make(map[string]*clientLimiter), 0
+	defer func() { limiters.m, limiters.rejected = make(map[string]*clientLimiter), 0 }()
+	h := throttled(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(addr, secret string) int {
+		r := httptest.NewRequest("GET", "/r/status", nil)
+		r.RemoteAddr = addr
+		if secret != "" {
+			r.Header.Set("Authorization", "Bearer "+secret)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	randomSecret := func() string {
+		b := make([]byte, 16)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}
+	// made up tokens from one address share its bucket
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		if code := request("192.0.2.1:1234", randomSecret()); code != want {
+			t.Errorf("request %d with a random token = %d, want %d", i, code, want)
+		}
+	}
+	if code := request("192.0.2.1:5678", ""); code != http.StatusTooManyRequests {
+		t.Errorf("request without a token from the same address = %d, want 429", code)
+	}
+	if len(limiters.m) != 1 {
+		t.Errorf("%d limiters, want 1", len(limiters.m))
+	}
+	if code := request("192.0.2.2:1234", randomSecret()); code != http.StatusOK {
+		t.Errorf("request from another address = %d, want 200", code)
+	}
+	// a real token has a bucket of its own, wherever it comes from
+	fileTokens.m = map[string]*Token{hashToken("0123456789abcdef"): {ID: "file-ci", Scopes: []string{"read:/"}}}
+	defer func() { fileTokens.m = make(map[string]*Token) }()
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := request("192.0.2.1:1234", "0123456789abcdef"); code != want {
+			t.Errorf("request %d with a token = %d, want %d", i, code, want)
+		}
+	}
+	if _, ok := limiters.m["token:file-ci"]; !ok {
+		t.Errorf("no limiter of the token: %v", limiters.m)
+	}
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"compress/gzip"
-	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -29,21 +29,74 @@ type Server struct {
 	logDir   string
 	logLevel string
 	dataDir  string
+	// unfinished upload sessions idle longer than this are removed
+	uploadSessionTimeout time.Duration
+	// digests computed for every upload besides md5
+	digests []string
+	// store identical content once in the blob store
+	dedup bool
+	// limits of decoding a compressed upload and of extracting an archive, 0 means no limit
+	maxDecodedSize      int64
+	maxCompressionRatio float64
+	maxArchiveEntries   int
+	// replaced versions kept per file, by default and by path prefix, 0 disables versioning
+	maxVersions   int
+	versionLimits map[string]int
+	// require an API token on every request, tokens come from tokenFile and the tokens bucket
+	auth      bool
+	tokenFile string
+	// HMAC key of signed URLs
+	signKeyFile string
+	// serve HTTPS, with client certificates of tlsClientCA mapped to scopes by clientCertFile
+	tlsCert           string
+	tlsKey            string
+	tlsClientCA       string
+	requireClientCert bool
+	clientCertFile    string
+	// limits of every client, by token, client certificate or address, 0 means no limit
+	rateLimit      float64
+	rateBurst      int
+	bandwidthLimit int64
+	// Cache-Control of downloads by path prefix
+	cacheControl map[string]string
+	// keep gzip compressed sidecars of compressible files up to gzipMaxSize
+	gzipSidecars bool
+	gzipMaxSize  int64
 }
 type FileInfo struct {
 	CreateTime   time.Time
 	Md5          string
-	ExpiredTime  time.Time
-	DownloadPath string `json:",omitempty"`
+	Digests      map[string]string `json:",omitempty"` // hex digests other than md5, keyed by algorithm
+	Blob         string            `json:",omitempty"` // sha256 of the shared blob if the file is deduplicated
+	Size         int64
+	GzipSize     int64             `json:",omitempty"` // size of the gzip sidecar
+	NotWorthGzip bool              `json:",omitempty"` // gzip does not make the file smaller
+	ContentType  string            `json:",omitempty"`
+	FileName     string            `json:",omitempty"` // name of the file on the client
+	Uploader     string            `json:",omitempty"` // address of the client
+	Version      int               `json:",omitempty"` // numbered from 1 if the path is versioned
+	Meta         map[string]string `json:",omitempty"` // user metadata, keys are lower case
+	Tags         []string          `json:",omitempty"`
+	ExpiredTime  *time.Time        // null if the file never expires
+	DownloadPath string            `json:",omitempty"`
 }
+
+// Expired reports whether the file has expired at now.
+func (f *FileInfo) Expired(now time.Time) bool {
+	return f.ExpiredTime != nil && f.ExpiredTime.Before(now)
+}
+
 type UploadResponseInfo struct {
 	ErrInfo
 	File FileInfo
 }
 type FileServerInfo struct {
 	ErrInfo
-	ID         string
-	FileNumber int
+	ID              string
+	FileNumber      int
+	BlobNumber      int            `json:",omitempty"`
+	DedupSavedBytes int64          `json:",omitempty"`
+	Throttle        *ThrottleStats `json:",omitempty"`
 }
 type FileInfoResponse struct {
 	ErrInfo
@@ -56,30 +109,179 @@ var db *bolt.DB
 var fileNum int = 0
 
 const DEFAULT_EXPIRED_TIME = "2400h"
+
+// TMP_DIR is the directory under dataDir which holds unfinished uploads.
+const TMP_DIR = ".tmp"
+
 /*
 Upload file handler
 Use blow instruction to upload file or construct post request by yourself:
 curl  -F "file=@bolt" -F dest=/jianwang/bolt.txt  -F expiredTime=2h  -F replaceIfExist=false  "http://localhost:50010/r/upload/"
+The expected digest of the stored content can be declared with X-Checksum-Md5/X-Checksum-Sha256 headers or md5/sha256 fields
+(sha512 and crc32c work the same way), Content-MD5 is checked against the request body as it is sent, multipart form and all,
+a mismatched upload is rejected and not stored:
+curl  -F "file=@bolt" -F dest=/jianwang/bolt.txt  -F sha256=$(sha256sum bolt | cut -d" " -f1)  "http://localhost:50010/r/upload/"
+expiredAt sets an RFC3339 expiry instead of expiredTime, and "never" keeps the file until it is deleted,
+its ExpiredTime is null then:
+curl  -F "file=@app.tar.gz" -F dest=/release/app.tar.gz  -F expiredAt=never  "http://localhost:50010/r/upload/"
+signDownload=24h makes the DownloadPath a signed URL valid for 24 hours, if the server has -signKeyFile
+Metadata is attached with X-Meta-<Key> headers or meta-<key> fields, tags with the X-Tags header or tags fields,
+both are returned by info and as headers of download:
+curl  -F "file=@app.tar.gz" -F dest=/release/app.tar.gz  -H "X-Meta-Git-Sha: 1a2b3c" -F meta-build=42  -F tags=release,linux  "http://localhost:50010/r/upload/"
+Size, ContentType, FileName and Uploader are recorded, the type and name of the file part can be overridden
+with contentType and filename fields, the type is sniffed if it is not declared
 Return value:
 {"Status":0,"Msg":"OK","File":{"CreateTime":"2017-08-15T16:03:19.257401537+08:00","Md5":"e286c3a32a578cff7b7a39dc943aa1e5",
+"Digests":{"sha256":"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
 "ExpiredTime":"2017-08-15T18:03:19.257405226+08:00","DownloadPath":"http://192.168.0.32:50011/r/download/jianwang/ads.111"}}
 */
 func upload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	log.Debugf("%s: %s, From: %s, Content-Encoding: %s", r.Method, r.RequestURI, r.RemoteAddr, r.Header.Get("Content-Encoding"))
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	contentMD5, err := checkContentMD5(r)
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_CHECKSUM))
+		return
+	}
 	r.ParseMultipartForm(32 << 20)
-	expiredDuration, err := time.ParseDuration(valuesGetDefault(r.Form, "expiredTime", DEFAULT_EXPIRED_TIME))
+	if contentMD5 != nil && !contentMD5() {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_CHECKSUM_MISMATCH))
+		return
+	}
+	exp, err := parseExpiry(valuesGetDefault(r.Form, "expiredTime", ""), valuesGetDefault(r.Form, "expiredAt", ""),
+		DEFAULT_EXPIRED_TIME)
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_EXPIRE))
+		return
+	}
+	reqPath, err := confineFilePath(valuesGetDefault(r.Form, "dest", ""))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	if !checkRight(w, r, reqPath, RIGHT_WRITE) {
+		return
+	}
+	checksums, err := parseChecksums(r.Header, r.Form)
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_CHECKSUM))
+		return
+	}
+	meta, tags, err := parseMeta(r.Header, r.Form)
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_META))
+		return
+	}
+	file, fileHeader, err := r.FormFile("file")
+	if err != nil {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_HTTP_GET_CONTENT))
+		return
+	}
+	defer file.Close()
+	saveFile(w, r, reqPath, file, uploadOptions{
+		expiry:         exp,
+		replaceIfExist: valuesGetDefault(r.Form, "replaceIfExist", "true"),
+		checksums:      checksums,
+		meta:           meta,
+		tags:           tags,
+		contentType:    declaredContentType(valuesGetDefault(r.Form, "contentType", fileHeader.Header.Get("Content-Type"))),
+		fileName:       cleanFileName(valuesGetDefault(r.Form, "filename", fileHeader.Filename)),
+		uploader:       remoteHost(r),
+		extract:        valuesGetDefault(r.Form, "extract", ""),
+	})
+}
+
+/*
+Upload file with the raw request body, nothing is buffered in memory or temp files
+The options are taken from query parameters or X-Expired-Time/X-Expired-At/X-Replace-If-Exist headers,
+the headers are ignored with a signed URL:
+curl -T bolt "http://localhost:50010/r/upload/jianwang/bolt.txt?expiredTime=2h&replaceIfExist=false"
+curl -T 1.png.gz -H "Content-Encoding: gzip" -H "X-Expired-Time: 2h" http://localhost:50010/r/upload/jianwang/3.png
+Content-Encoding may be gzip, deflate, br, zstd or identity, stacked ones like "gzip, zstd" are decoded in reverse order
+The ContentType and FileName come from the Content-Type and Content-Disposition headers, or contentType and filename parameters
+Return value is the same as POST upload
+*/
+func uploadRaw(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s, Content-Encoding: %s", r.Method, r.RequestURI, r.RemoteAddr, r.Header.Get("Content-Encoding"))
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	// r.ParseForm would read the body of a form-encoded request, so only look at the query
+	query := r.URL.Query()
+	// the options of a signed URL are in its signed query, the holder of the URL can't change them with headers
+	optionHeader := r.Header
+	if isSigned(r) {
+		optionHeader = http.Header{}
+	}
+	exp, err := parseExpiry(valuesGetDefault(query, "expiredTime", optionHeader.Get("X-Expired-Time")),
+		valuesGetDefault(query, "expiredAt", optionHeader.Get("X-Expired-At")), DEFAULT_EXPIRED_TIME)
 	if err != nil {
 		log.Warn(err)
 		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_EXPIRE))
 		return
 	}
-	reqPath := valuesGetDefault(r.Form, "dest", "")
-	if len(reqPath) <= 1 || reqPath[0] != '/' {
-		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_PATH))
+	reqPath := ps.ByName("filepath") // confined
+	checksums, err := parseChecksums(r.Header, query)
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_CHECKSUM))
+		return
+	}
+	meta, tags, err := parseMeta(r.Header, query)
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_META))
+		return
+	}
+	contentMD5, err := checkContentMD5(r)
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_CHECKSUM))
+		return
+	}
+	saveFile(w, r, reqPath, r.Body, uploadOptions{
+		expiry:         exp,
+		replaceIfExist: valuesGetDefault(query, "replaceIfExist", headerGetDefault(optionHeader, "X-Replace-If-Exist", "true")),
+		checksums:      checksums,
+		meta:           meta,
+		tags:           tags,
+		contentType:    declaredContentType(valuesGetDefault(query, "contentType", r.Header.Get("Content-Type"))),
+		fileName:       cleanFileName(valuesGetDefault(query, "filename", declaredFileName(r.Header.Get("Content-Disposition")))),
+		uploader:       remoteHost(r),
+		extract:        valuesGetDefault(query, "extract", headerGetDefault(optionHeader, "X-Extract", "")),
+		contentMD5:     contentMD5,
+	})
+}
+
+// uploadOptions are the options of upload which apply to the stored file.
+type uploadOptions struct {
+	expiry         expiry
+	replaceIfExist string
+	checksums      map[string][]byte // expected digests declared by the client
+	meta           map[string]string
+	tags           []string
+	contentType    string // declared by the client, sniffed if empty
+	fileName       string
+	uploader       string
+	extract        string      // archive format to extract content as, see saveArchive
+	contentMD5     func() bool // checks the body against Content-MD5 once it is staged, see checkContentMD5
+}
+
+// saveFile streams content to reqPath, saves its FileInfo and writes the upload response.
+func saveFile(w http.ResponseWriter, r *http.Request, reqPath string, content io.Reader, opts uploadOptions) {
+	decoded, err := newContentDecoder(r.Header, content)
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(contentErrCode(err)))
+		return
+	}
+	defer decoded.Close()
+	if opts.extract != "" && opts.extract != "false" && opts.extract != "0" {
+		saveArchive(w, r, reqPath, decoded, opts)
 		return
 	}
-	downloadPath := "http://" + r.Host + "/r/download" + reqPath
 	localPath := path.Join(svr.dataDir, reqPath)
 	if st, err := os.Stat(localPath); err != nil {
 		if !os.IsNotExist(err) {
@@ -91,90 +293,42 @@ func upload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 			json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_EXIST_DIR))
 			return
 		}
-		replaceIfExist := valuesGetDefault(r.Form, "replaceIfExist", "true")
-		if strings.ToLower(replaceIfExist) != "true" && replaceIfExist != "1" {
+		if strings.ToLower(opts.replaceIfExist) != "true" && opts.replaceIfExist != "1" {
 			// TODO: get file info here
 			json.NewEncoder(w).Encode(UploadResponseInfo{ErrInfo: ErrInfo{Status: ERR_OK,
 				Msg: "file exist"}})
 			return
 		}
-		oErr := os.Remove(localPath)
-	        if oErr != nil {
-			log.Error(err)
-		} else {
-			log.Debug("delete exist file success:" + localPath)
-		}
-	}
-	if err := os.MkdirAll(path.Dir(localPath), os.ModePerm); err != nil {
-		log.Error(err)
-		json.NewEncoder(w).Encode(MakeErrInfo(ERR_MKDIR))
-		return
 	}
-	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE, 0666)
+	// write into a staging file, the target is only replaced after the FileInfo is saved
+	stagePath, digests, err := stageContent(decoded, opts.checksums)
 	if err != nil {
-		log.Error(err)
-		json.NewEncoder(w).Encode(MakeErrInfo(ERR_OPEN_FILE))
+		log.Warnf("%s: %v", reqPath, err)
+		json.NewEncoder(w).Encode(MakeErrInfo(contentErrCode(err)))
 		return
 	}
-	defer f.Close()
-
-	contentIsCompressed := false
-	for _, v := range r.Header["Content-Encoding"] {
-		if v == "gzip" {
-			contentIsCompressed = true
-		}
-	}
-	file, _, err := r.FormFile("file")
-	if err != nil {
-		json.NewEncoder(w).Encode(MakeErrInfo(ERR_HTTP_GET_CONTENT))
+	defer os.Remove(stagePath) // fails harmlessly once the staging file has been published
+	if algo, ok := digests.Verify(opts.checksums); !ok {
+		log.Warnf("%s: %s checksum mismatch, expected: %x, got: %x", reqPath, algo, opts.checksums[algo], digests[algo].Sum(nil))
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_CHECKSUM_MISMATCH))
 		return
 	}
-	defer file.Close()
-
-	var size int64 = 0
-	md5Writer := md5.New()
-	if contentIsCompressed {
-		//for gzip compressed file
-		gr, err := gzip.NewReader(file)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer gr.Close()
-		size, _ = io.Copy(io.MultiWriter(md5Writer, f), gr)
-		log.Debugf(`Recv %v plaintext bytes size`, size)
-	} else {
-		//for not use gzip compressed file
-		size, _ = io.Copy(io.MultiWriter(md5Writer, f), file)
-		log.Debugf(`Recv %v plaintext bytes size`, size)
-	}
-	fileInfo := &FileInfo{
-		CreateTime:  time.Now(),
-		Md5:         fmt.Sprintf("%x", md5Writer.Sum(nil)),
-		ExpiredTime: time.Now().Add(expiredDuration),
+	if opts.contentMD5 != nil && !opts.contentMD5() {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_CHECKSUM_MISMATCH))
+		return
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("fileInfo"))
-		if b == nil {
-			return fmt.Errorf("read db error")
-		}
-		encoded, err := json.Marshal(fileInfo)
-		if err != nil {
-			return err
-		}
-		log.Debugf("Write DB: %s: %s", reqPath, string(encoded))
-		return b.Put([]byte(reqPath), encoded)
-
-	})
+	fileInfo, err := newFileInfo(reqPath, stagePath, digests, opts)
 	if err != nil {
-		// need to delete file
-		deleteFileOnDisk(localPath)
 		log.Error(err)
-		json.NewEncoder(w).Encode(MakeErrInfo(ERR_UPDATE_DB))
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_OPEN_FILE))
+		return
+	}
+	if errCode := publishFile(stagePath, reqPath, fileInfo); errCode != ERR_OK {
+		json.NewEncoder(w).Encode(MakeErrInfo(errCode))
 		return
 	}
 	// success
-	fileNum++
-	fileInfo.DownloadPath = downloadPath
+	fileInfo.DownloadPath = downloadPath(r, reqPath, nil)
 	responseInfo := UploadResponseInfo{
 		ErrInfo: MakeErrInfo(ERR_OK),
 		File:    *fileInfo,
@@ -182,25 +336,111 @@ func upload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	json.NewEncoder(w).Encode(responseInfo)
 	return
 }
+
+// stageContent writes content into a synced staging file and digests it on the way.
+// The staging file is removed on error, otherwise it is up to the caller.
+func stageContent(content io.Reader, checksums map[string][]byte) (string, digester, error) {
+	f, err := createStageFile()
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	digests := newDigester(checksums)
+	// the file goes first, so a disk error comes back from io.Copy as is
+	size, err := io.Copy(io.MultiWriter(f, digests), content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		log.Warnf("receive failed after %v bytes", size)
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	log.Debugf(`Recv %v plaintext bytes size`, size)
+	return f.Name(), digests, nil
+}
+
 /*
 Download file from server
 Normal download:
 curl -O http://localhost:50010/r/download_file/jianwang/ads.111
 Gzip compress mode to download:
 curl -H "Accept-Encoding: gzip"  http://localhost:50010/r/download_file/jianwang/ads.111 | gunzip >a.dmg
+The coding the client weighs most is used, zstd, br, gzip, deflate first among equals, and identity;q=0 gets 406 if none fits.
+Range requests, compressed types and files not worth compressing are served as is, so identity;q=0 gets 406 for them too:
+curl -H "Accept-Encoding: br;q=1, gzip;q=0.5" http://localhost:50010/r/download/jianwang/ads.111 | brotli -d >a.dmg
+A kept version of a file:
+curl -O "http://localhost:50010/r/download/jianwang/ads.111?version=2"
+The ETag is the quoted Md5 and Last-Modified the CreateTime, a conditional request of an unchanged file gets 304:
+curl -H 'If-None-Match: "e286c3a32a578cff7b7a39dc943aa1e5"' http://localhost:50010/r/download/jianwang/ads.111
 */
 func download(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	log.Debugf("header: %v", r.Header)
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
 	reqPath := ps.ByName("filepath")
 	localPath := path.Join(svr.dataDir, reqPath)
+	var fileInfo *FileInfo
+	var err error
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil || version <= 0 {
+			http.Error(w, "invalid version: "+v, http.StatusBadRequest)
+			return
+		}
+		if fileInfo, err = getVersion(reqPath, version); err != nil {
+			log.Error(err)
+		} else if fileInfo == nil {
+			http.Error(w, fmt.Sprintf("version %d of %s not found", version, reqPath), http.StatusNotFound)
+			return
+		}
+		localPath = versionPath(reqPath, version)
+	} else if fileInfo, err = getFileInfo(reqPath); err != nil {
+		log.Error(err)
+	} else if fileInfo != nil && fileInfo.ContentType == "" {
+		backfillFileInfo(reqPath, fileInfo)
+	}
 	streamBytes, err := os.Open(localPath)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Unable to open and read file : %v", err), 500)
 		return
 	}
 	defer streamBytes.Close()
-	httpgzip.ServeContent(w, r, localPath, time.Time{}, streamBytes)
+	var modTime time.Time
+	if fileInfo != nil {
+		setDigestHeaders(w.Header(), fileInfo)
+		setMetaHeaders(w.Header(), fileInfo)
+		if fileInfo.ContentType != "" {
+			w.Header().Set("Content-Type", fileInfo.ContentType)
+		}
+		if fileInfo.Md5 != "" {
+			w.Header().Set("ETag", `"`+fileInfo.Md5+`"`)
+		}
+		modTime = fileInfo.CreateTime
+	}
+	if cc := cacheControl(reqPath); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+	var content io.ReadSeeker = streamBytes
+	if fileInfo != nil {
+		content = gzipVariant(r, streamBytes, fileInfo)
+	}
+	// the name only matters for the Content-Type, a version file has no extension
+	httpgzip.ServeContent(w, r, reqPath, modTime, content)
 }
+
+/*
+List a directory or get a file of dataDir
+curl http://localhost:50010/r/list/jianwang/
+*/
+func list(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	// the path is passed on as it is, the file server redirects directories to a trailing slash
+	if _, err := confinePath(ps.ByName("filepath")); err != nil {
+		writePathError(w, err)
+		return
+	}
+	r.URL.Path = ps.ByName("filepath")
+	http.FileServer(confinedDir(svr.dataDir)).ServeHTTP(w, r)
+}
+
 /*
 Backup database
 curl  -o my.db http://localhost:50010/r/backup
@@ -221,6 +461,8 @@ func backup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 Get file Server status
 curl http://localhost:50010/r/status
 {"Status":200,"Msg":"Online","IP":"172.24.48.137","FileNumber":5}
+With -dedup, BlobNumber and DedupSavedBytes tell how much space is saved by sharing blobs
+With -rateLimit or -bandwidthLimit, Throttle shows the limits and what they did to the clients active lately
 */
 func status(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	log.Debugf("%s: %s, From: %s, Accept-Encoding: %s", r.Method, r.RequestURI, r.RemoteAddr, r.Header.Get("Accept-Encoding"))
@@ -244,10 +486,14 @@ func status(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		}
 	}
 	count := fileNum
+	blobs, saved := dedupStats()
 	fileServer := FileServerInfo{
-		ErrInfo:    MakeErrInfo(ERR_OK),
-		ID:         hostOrIp + ":" + svr.port,
-		FileNumber: count,
+		ErrInfo:         MakeErrInfo(ERR_OK),
+		ID:              hostOrIp + ":" + svr.port,
+		FileNumber:      count,
+		BlobNumber:      blobs,
+		DedupSavedBytes: saved,
+		Throttle:        throttleStats(),
 	}
 	json.NewEncoder(w).Encode(fileServer)
 }
@@ -255,6 +501,7 @@ func status(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 Get file Info or folder Info
 file info: curl http://localhost:50010/r/info/data/danny/456.log
 folder info: curl http://localhost:50010/r/info/\?isDir\=true\&recursion\=true\&suffix\=.log
+signed download path: curl http://localhost:50010/r/info/data/danny/456.log?signDownload=1h
 */
 func info(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
@@ -295,20 +542,7 @@ func info(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		}
 
 	} else {
-		var fileInfo *FileInfo
-		err := db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("fileInfo"))
-			if b == nil {
-				return fmt.Errorf("read db error")
-			}
-			v := b.Get([]byte(reqPath))
-			if v == nil {
-				return nil
-			}
-			fileInfo = &FileInfo{}
-			err := json.Unmarshal(v, fileInfo)
-			return err
-		})
+		fileInfo, err := getFileInfo(reqPath)
 		if err != nil {
 			log.Error(err)
 			json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
@@ -318,7 +552,7 @@ func info(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 			json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_NOT_IN_DB))
 			return
 		}
-		if fileInfo.ExpiredTime.Before(time.Now()) {
+		if fileInfo.Expired(time.Now()) {
 			deleteFilesBothDiskAndDB(map[string]*FileInfo{reqPath: fileInfo})
 		}
 		localPath := path.Join(svr.dataDir, reqPath)
@@ -326,7 +560,10 @@ func info(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 			json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_NOT_EXIST))
 			return
 		}
-		fileInfo.DownloadPath = "http://" + r.Host + "/r/download" + reqPath
+		if fileInfo.ContentType == "" {
+			backfillFileInfo(reqPath, fileInfo)
+		}
+		fileInfo.DownloadPath = downloadPath(r, reqPath, nil)
 		json.NewEncoder(w).Encode(FileInfoResponse{
 			ErrInfo: MakeErrInfo(ERR_OK),
 			File:    *fileInfo,
@@ -335,6 +572,236 @@ func info(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 }
 
+// getFileInfo reads the FileInfo of reqPath from the fileInfo bucket, it returns nil if there is none.
+func getFileInfo(reqPath string) (*FileInfo, error) {
+	var fileInfo *FileInfo
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileInfo"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		v := b.Get([]byte(reqPath))
+		if v == nil {
+			return nil
+		}
+		fileInfo = &FileInfo{}
+		return json.Unmarshal(v, fileInfo)
+	})
+	return fileInfo, err
+}
+
+// putFileInfo writes the FileInfo of reqPath into the fileInfo bucket.
+func putFileInfo(reqPath string, fileInfo *FileInfo) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileInfo"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		encoded, err := json.Marshal(fileInfo)
+		if err != nil {
+			return err
+		}
+		log.Debugf("Write DB: %s: %s", reqPath, string(encoded))
+		return b.Put([]byte(reqPath), encoded)
+	})
+}
+
+// createStageFile creates a file under TMP_DIR to receive an upload before it is published.
+// Unlike ioutil.TempFile, which creates 0600 files, it uses 0666 less the umask like os.Create,
+// the mode the file keeps once it is renamed into place.
+func createStageFile() (*os.File, error) {
+	dir := path.Join(svr.dataDir, TMP_DIR)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 8)
+	for {
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path.Join(dir, "stage-"+hex.EncodeToString(suffix)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+// deleteStaleStageFiles removes staging files left behind by a crash.
+func deleteStaleStageFiles() {
+	files, err := filepath.Glob(path.Join(svr.dataDir, TMP_DIR, "stage-*"))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	deadline := time.Now().Add(-svr.uploadSessionTimeout)
+	for _, f := range files {
+		if st, err := os.Stat(f); err == nil && st.ModTime().Before(deadline) {
+			log.Debugf("remove stale staging file: %s", f)
+			if err := os.Remove(f); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// publishFile saves the FileInfo of reqPath, then renames the synced stagePath over the target.
+// If anything fails, the previous file and its FileInfo are left as they were.
+// With dedup the content goes to the blob store first, and the target becomes a link to the blob.
+func publishFile(stagePath, reqPath string, fileInfo *FileInfo) ErrCode {
+	return publish(stagePath, reqPath, fileInfo, "")
+}
+
+// publish is publishFile, if movedFrom is not empty, stagePath is the file of movedFrom,
+// and its record is deleted in the same transaction.
+func publish(stagePath, reqPath string, fileInfo *FileInfo, movedFrom string) ErrCode {
+	localPath := path.Join(svr.dataDir, reqPath)
+	if err := os.MkdirAll(path.Dir(localPath), os.ModePerm); err != nil {
+		log.Error(err)
+		return ERR_MKDIR
+	}
+	blobMu.Lock()
+	defer blobMu.Unlock()
+	var blobSize int64
+	newBlob := false
+	if sum := fileInfo.Digests["sha256"]; svr.dedup && sum != "" {
+		size, created, err := stageBlob(stagePath, sum)
+		if err != nil {
+			log.Warnf("%s is stored without dedup: %v", reqPath, err)
+		} else {
+			fileInfo.Blob, blobSize, newBlob = sum, size, created
+		}
+	}
+	// the replaced file is kept as a version if reqPath is versioned
+	limit := versionLimit(reqPath)
+	keepOld := limit > 0 && checkFileIsExist(localPath)
+	var kept *FileInfo
+	var dropped []*FileInfo
+	snapshot := dbSnapshot{}
+	exist := false
+	releasedBlobs := make([]string, 0)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileInfo"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		snapshot.save(tx, "fileInfo", reqPath)
+		if v := b.Get([]byte(reqPath)); v != nil {
+			exist = true
+			old := &FileInfo{}
+			if err := json.Unmarshal(v, old); err != nil {
+				log.Error(err)
+			} else if keepOld {
+				var released []string
+				var err error
+				if dropped, released, err = keepVersion(tx, snapshot, reqPath, old, limit); err != nil {
+					return err
+				}
+				kept = old
+				releasedBlobs = append(releasedBlobs, released...)
+			} else if old.Blob != "" {
+				snapshot.save(tx, "blobs", old.Blob)
+				last, err := releaseBlob(tx, old.Blob)
+				if err != nil {
+					return err
+				}
+				if last {
+					releasedBlobs = append(releasedBlobs, old.Blob)
+				}
+			}
+		}
+		fileInfo.Version = 0
+		if limit > 0 {
+			fileInfo.Version = lastVersion(tx, reqPath) + 1
+		}
+		if fileInfo.Blob != "" {
+			snapshot.save(tx, "blobs", fileInfo.Blob)
+			if err := retainBlob(tx, fileInfo.Blob, blobSize); err != nil {
+				return err
+			}
+		}
+		if movedFrom != "" {
+			snapshot.save(tx, "fileInfo", movedFrom)
+			if v := b.Get([]byte(movedFrom)); v != nil {
+				moved := &FileInfo{}
+				if err := json.Unmarshal(v, moved); err == nil && moved.Blob != "" {
+					// the reference of the moved file is taken over by fileInfo
+					snapshot.save(tx, "blobs", moved.Blob)
+					if _, err := releaseBlob(tx, moved.Blob); err != nil {
+						return err
+					}
+				}
+			}
+			if err := b.Delete([]byte(movedFrom)); err != nil {
+				return err
+			}
+		}
+		encoded, err := json.Marshal(fileInfo)
+		if err != nil {
+			return err
+		}
+		log.Debugf("Write DB: %s: %s", reqPath, string(encoded))
+		return b.Put([]byte(reqPath), encoded)
+	})
+	if err == nil && kept != nil {
+		// the version shares the inode of the replaced file, which stays in place until the rename
+		vp := versionPath(reqPath, kept.Version)
+		if err = os.MkdirAll(path.Dir(vp), os.ModePerm); err == nil {
+			os.Remove(vp) // left over by a failed publish
+			err = os.Link(localPath, vp)
+		}
+		if err != nil {
+			if err := db.Update(snapshot.restore); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	if err == nil {
+		if err = os.Rename(stagePath, localPath); err != nil {
+			// put the previous records back, the previous file is still in place
+			if err := db.Update(snapshot.restore); err != nil {
+				log.Error(err)
+			}
+			if kept != nil {
+				os.Remove(versionPath(reqPath, kept.Version))
+			}
+		}
+	}
+	if err != nil {
+		log.Error(err)
+		if newBlob {
+			removeBlobFile(fileInfo.Blob)
+		}
+		switch err.(type) {
+		case *os.LinkError, *os.PathError:
+			return ERR_WRITE_FILE
+		}
+		return ERR_UPDATE_DB
+	}
+	if d, err := os.Open(path.Dir(localPath)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	for _, version := range dropped {
+		log.Debugf("drop version %d of %s", version.Version, reqPath)
+		deleteFileOnDisk(versionPath(reqPath, version.Version))
+	}
+	// re-uploading the same content keeps the blob, as it is retained again in the same transaction
+	for _, sum := range releasedBlobs {
+		if sum != fileInfo.Blob {
+			removeBlobFile(sum)
+		}
+	}
+	if !exist {
+		fileNum++
+	}
+	if movedFrom != "" {
+		fileNum--
+		removeEmptyDirs(path.Join(svr.dataDir, movedFrom))
+	}
+	queueGzipSidecar(reqPath, fileInfo)
+	return ERR_OK
+}
+
 /**
  * check if file exists, if exists, return true, else return false
  */
@@ -348,11 +815,7 @@ func checkFileIsExist(filename string) bool {
 func clean(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
-	var returnFiles struct {
-		ErrInfo
-		NumDeletedFiles int
-		DeletedFiles    map[string]*FileInfo
-	}
+	var returnFiles DeleteResponseInfo
 	returnFiles.DeletedFiles = getExpiredFiles()
 	returnFiles.NumDeletedFiles = len(returnFiles.DeletedFiles)
 	deleteFilesBothDiskAndDB(returnFiles.DeletedFiles)
@@ -365,6 +828,11 @@ func deleteExpiredFile() {
 	ticker := time.NewTicker(time.Hour * 2)
 	for range ticker.C {
 		deleteFilesBothDiskAndDB(getExpiredFiles())
+		deleteExpiredVersions()
+		deleteExpiredUploadSessions()
+		deleteStaleStageFiles()
+		deleteUnusedGzipSidecars()
+		queueGzipSidecars()
 	}
 }
 
@@ -382,10 +850,10 @@ func getExpiredFiles() (files map[string]*FileInfo) {
 			temp := &FileInfo{}
 			err := json.Unmarshal(v, temp)
 			if err != nil {
-				fmt.Errorf("error: %v", err)
+				log.Errorf("%s: %v", k, err)
 				continue
 			}
-			if temp.ExpiredTime.Before(now) {
+			if temp.Expired(now) {
 				files[string(k)] = temp
 			}
 		}
@@ -402,16 +870,34 @@ func deleteFilesBothDiskAndDB(files map[string]*FileInfo) {
 		if err := os.Remove(localPath); err != nil {
 			log.Error(err)
 		}
+		releasedBlob := ""
+		blobMu.Lock()
 		err := db.Update(func(tx *bolt.Tx) error {
 			b := tx.Bucket([]byte("fileInfo"))
 			if b == nil {
 				return fmt.Errorf("read db error")
 			}
+			// the record may have been replaced since files was read, release the blob it references now
+			if v := b.Get([]byte(f)); v != nil {
+				temp := &FileInfo{}
+				if err := json.Unmarshal(v, temp); err == nil && temp.Blob != "" {
+					last, err := releaseBlob(tx, temp.Blob)
+					if err != nil {
+						return err
+					}
+					if last {
+						releasedBlob = temp.Blob
+					}
+				}
+			}
 			return b.Delete([]byte(f))
 		})
 		if err != nil {
 			log.Error(err)
+		} else if releasedBlob != "" {
+			removeBlobFile(releasedBlob)
 		}
+		blobMu.Unlock()
 		fileNum--
 		for dir := path.Dir(localPath); dir != svr.dataDir && len(dir) > len(svr.dataDir); dir = path.Dir(dir) {
 			dirs[dir] = true
@@ -448,6 +934,11 @@ func deleteFileOnDisk(localPath string) {
 	if err := os.Remove(localPath); err != nil {
 		log.Error(err)
 	}
+	removeEmptyDirs(localPath)
+}
+
+// removeEmptyDirs removes the parent directories of localPath which became empty, up to dataDir.
+func removeEmptyDirs(localPath string) {
 	dirsList := make([]string, 0, 0)
 	for dir := path.Dir(localPath); dir != svr.dataDir && len(dir) > len(svr.dataDir); dir = path.Dir(dir) {
 		dirsList = append(dirsList, dir)
@@ -471,7 +962,14 @@ func deleteFileOnDisk(localPath string) {
 		}
 		f.Close()
 	}
+}
 
+func headerGetDefault(header http.Header, key, defaultValue string) string {
+	v := header.Get(key)
+	if v == "" {
+		return defaultValue
+	}
+	return v
 }
 
 func valuesGetDefault(values url.Values, key, defaultValue string) string {
@@ -491,9 +989,11 @@ func InitDB() (*bolt.DB, error) {
 		return nil, fmt.Errorf("could not open db, %v", dbErr)
 	}
 	dbErr = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("fileInfo"))
-		if err != nil {
-			return fmt.Errorf("could not create root bucket: %v", err)
+		for _, name := range []string{"fileInfo", "uploadSession", "blobs", "fileVersions", "tokens"} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("could not create root bucket: %v", err)
+			}
 		}
 		return nil
 	})
@@ -550,6 +1050,9 @@ func WalkDir(dirPth, suffix string) (files []string, err error) {
 			return err
 		}
 		if fi.IsDir() { // Ignore directory
+			if isReservedDir(filename) {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 		if strings.HasSuffix(strings.ToUpper(fi.Name()), suffix) {
@@ -565,6 +1068,28 @@ func main() {
 	flag.StringVar(&svr.dataDir, "dataDir", "data", "data directory")
 	flag.StringVar(&svr.port, "port", "50010", "web api port")
 	flag.StringVar(&svr.logLevel, "logLevel", "MORE", `log level: NORMAL, MORE, MUCH`)
+	digestList := flag.String("digests", "sha256", "comma separated digests computed for every upload besides md5: sha256, sha512, crc32c")
+	flag.BoolVar(&svr.dedup, "dedup", false, "store identical content once, every path links to a shared blob, needs sha256 in digests")
+	flag.Int64Var(&svr.maxDecodedSize, "maxDecodedSize", 0, "reject compressed uploads which decode to more bytes than this, 0 means no limit")
+	flag.Float64Var(&svr.maxCompressionRatio, "maxCompressionRatio", 100, "reject compressed uploads which expand more than this ratio, 0 means no limit")
+	flag.IntVar(&svr.maxArchiveEntries, "maxArchiveEntries", 10000, "reject archives of more entries than this, 0 means no limit")
+	flag.IntVar(&svr.maxVersions, "maxVersions", 0, "replaced versions kept per file, 0 disables versioning")
+	versionLimits := flag.String("versionLimits", "", "comma separated prefix=N, replaced versions kept under prefix, overrides maxVersions")
+	flag.BoolVar(&svr.auth, "auth", false, "require an API token with a scope of the path on every request")
+	flag.StringVar(&svr.tokenFile, "tokenFile", "", "JSON file of API tokens besides the ones created with /r/tokens")
+	flag.StringVar(&svr.signKeyFile, "signKeyFile", "", "file of the HMAC key of signed URLs, URLs can't be signed without it")
+	flag.StringVar(&svr.tlsCert, "tlsCert", "", "certificate file, the server speaks HTTPS with it, reloaded on SIGHUP")
+	flag.StringVar(&svr.tlsKey, "tlsKey", "", "private key file of tlsCert")
+	flag.StringVar(&svr.tlsClientCA, "tlsClientCA", "", "CA bundle which verifies client certificates")
+	flag.BoolVar(&svr.requireClientCert, "requireClientCert", false, "reject clients without a certificate of tlsClientCA")
+	flag.StringVar(&svr.clientCertFile, "clientCertFile", "", "JSON file which maps client certificate subjects to scopes, needs -auth")
+	flag.Float64Var(&svr.rateLimit, "rateLimit", 0, "requests per second of a client, by token, client certificate or address, 0 means no limit")
+	flag.IntVar(&svr.rateBurst, "rateBurst", 10, "requests a client may make at once above rateLimit")
+	flag.Int64Var(&svr.bandwidthLimit, "bandwidthLimit", 0, "bytes per second of a client, each for uploads and downloads, 0 means no limit")
+	cacheControlList := flag.String("cacheControl", "", `semicolon separated prefix=value, Cache-Control of downloads under prefix, like "/release=public, max-age=86400;/nightly=no-cache"`)
+	flag.BoolVar(&svr.gzipSidecars, "gzipSidecars", false, "keep a gzip compressed copy of compressible files, served to clients which accept gzip, needs sha256 in digests")
+	flag.Int64Var(&svr.gzipMaxSize, "gzipMaxSize", 16<<20, "largest file which gets a gzip sidecar, larger ones are compressed while they are sent")
+	flag.DurationVar(&svr.uploadSessionTimeout, "uploadSessionTimeout", 24*time.Hour, "remove unfinished upload sessions idle longer than this")
 	flag.Parse()
 	var verbose log.VerboseLevel
 	switch svr.logLevel {
@@ -593,10 +1118,33 @@ func main() {
 		log.Warn(err)
 	}
 	var err error
+	if svr.digests, err = parseDigestList(*digestList); err != nil {
+		log.Fatal(err)
+	}
+	// blobs and sidecars are shared by sha256, md5 collides too easily to tell contents apart
+	if (svr.dedup || svr.gzipSidecars) && !computesDigest("sha256") {
+		log.Warn("-dedup and -gzipSidecars need sha256 in -digests, files are stored without blobs and sidecars")
+	}
+	if svr.cacheControl, err = parseCacheControl(*cacheControlList); err != nil {
+		log.Fatal(err)
+	}
+	if svr.versionLimits, err = parseVersionLimits(*versionLimits); err != nil {
+		log.Fatal(err)
+	}
 	svr.dataDir, err = filepath.Abs(svr.dataDir)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if svr.tokenFile != "" {
+		if err := loadTokenFile(svr.tokenFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if svr.signKeyFile != "" {
+		if err := loadSignKey(svr.signKeyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 	if _, err := InitDB(); err == nil {
 		log.Println("DB init done")
 		fileNum = getFileNumInDB()
@@ -606,15 +1154,50 @@ func main() {
 	}
 	defer db.Close()
 	go deleteExpiredFile()
+	if svr.gzipSidecars {
+		go gzipSidecarWorker()
+	}
 	router := httprouter.New()
-	router.ServeFiles("/r/list/*filepath", http.Dir(svr.dataDir))
-	router.GET("/r/status", status)
-	router.POST("/r/upload/*filepath", upload) // support http gzip compressed
-	router.GET("/r/download/*filepath", download)
-	router.GET("/r/info/*filepath", info)
-	router.GET("/r/clean/", clean)
-	router.GET("/r/backup", backup)
+	router.GET("/r/list/*filepath", authorized(RIGHT_READ, list))
+	router.GET("/r/status", encoded(authenticated(RIGHT_READ, status)))
+	router.POST("/r/upload/*filepath", encoded(authenticated(RIGHT_WRITE, upload))) // support http gzip compressed
+	router.PUT("/r/upload/*filepath", encoded(confinedFile(authorized(RIGHT_WRITE, uploadRaw))))
+	router.POST("/r/uploads/", encoded(authenticated(RIGHT_WRITE, createUploadSession)))
+	router.GET("/r/uploads/:id", encoded(authenticated(RIGHT_WRITE, getUploadSession)))
+	router.PATCH("/r/uploads/:id", encoded(authenticated(RIGHT_WRITE, uploadChunk)))
+	router.PUT("/r/uploads/:id", encoded(authenticated(RIGHT_WRITE, finishUploadSession)))
+	router.DELETE("/r/uploads/:id", encoded(authenticated(RIGHT_WRITE, abortUploadSession)))
+	router.GET("/r/download/*filepath", confinedFile(authorized(RIGHT_READ, download)))
+	router.GET("/r/info/*filepath", encoded(confined(authorized(RIGHT_READ, info))))
+	router.GET("/r/clean/", encoded(adminOnly(clean)))
+	router.POST("/r/copy", encoded(authenticated(RIGHT_READ, copyFile)))
+	router.POST("/r/move", encoded(authenticated(RIGHT_WRITE, moveFile)))
+	router.PATCH("/r/files/*filepath", encoded(confinedFile(authorized(RIGHT_WRITE, updateExpiry))))
+	router.DELETE("/r/files/*filepath", encoded(confinedFile(authorized(RIGHT_WRITE, deleteFiles))))
+	router.GET("/r/versions/*filepath", encoded(confinedFile(authorized(RIGHT_READ, listVersions))))
+	router.POST("/r/restore/*filepath", encoded(confinedFile(authorized(RIGHT_WRITE, restoreVersion))))
+	router.GET("/r/backup", adminOnly(backup))
+	router.POST("/r/sign/*filepath", encoded(confinedFile(authorized(RIGHT_READ, signFile))))
+	router.POST("/r/tokens", encoded(adminOnly(createToken)))
+	router.GET("/r/tokens", encoded(adminOnly(listTokens)))
+	router.DELETE("/r/tokens/:id", encoded(adminOnly(deleteToken)))
+	if svr.tlsCert != "" {
+		if err := loadTLS(); err != nil {
+			log.Fatal(err)
+		}
+		go reloadTLSOnSIGHUP()
+	}
+	if svr.auth {
+		if err := checkAdminToken(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if svr.tlsCert != "" {
+		server := &http.Server{Addr: ":" + svr.port, Handler: throttled(router), TLSConfig: newTLSConfig()}
+		log.Infof("run server on: %s with TLS", svr.port)
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
 	log.Infof("run server on: %s", svr.port)
-	http.ListenAndServe(":"+svr.port, router)
+	http.ListenAndServe(":"+svr.port, throttled(router))
 
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer runs a test on a fresh dataDir and db in a temporary directory, the db is
+// opened in the working directory like InitDB does on startup.
+func testServer(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	saved := *svr
+	svr.dataDir = filepath.Join(dir, "data")
+	if _, err := InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		*svr = saved
+		os.Chdir(wd)
+	})
+}
+
+// writeFile writes content into a temporary file and returns its name.
+func writeFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// call runs handler h with r, ps are the parameters the router would pass.
+func call(h httprouter.Handle, r *http.Request, ps ...httprouter.Param) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, r, httprouter.Params(ps))
+	return w
+}
+
+// formRequest returns a request of method to target with the url-encoded fields as its body.
+func formRequest(method, target string, fields url.Values) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(fields.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// decodeJSON decodes the JSON response of w into v.
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("%d %q: %v", w.Code, w.Body.String(), err)
+	}
+}
+
+// storeFile uploads content to reqPath with uploadRaw, query holds the options of the upload.
+// The test fails unless the file is stored, its FileInfo is returned.
+func storeFile(t *testing.T, reqPath, content string, query url.Values) FileInfo {
+	t.Helper()
+	r := httptest.NewRequest("PUT", "/r/upload"+reqPath+"?"+query.Encode(), strings.NewReader(content))
+	w := call(uploadRaw, r, httprouter.Param{Key: "filepath", Value: reqPath})
+	var resp UploadResponseInfo
+	decodeJSON(t, w, &resp)
+	if resp.Status != ERR_OK || resp.Msg != "OK" {
+		t.Fatalf("upload %s: %s", reqPath, w.Body.String())
+	}
+	return resp.File
+}
+
+// readStored returns the content of reqPath in dataDir, "" if it does not exist.
+func readStored(t *testing.T, reqPath string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(svr.dataDir, reqPath))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestUploadRaw(t *testing.T) {
+	testServer(t)
+	upload := func(reqPath, target, content string, header map[string]string) UploadResponseInfo {
+		r := httptest.NewRequest("PUT", target, strings.NewReader(content))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		var resp UploadResponseInfo
+		decodeJSON(t, call(uploadRaw, r, httprouter.Param{Key: "filepath", Value: reqPath}), &resp)
+		return resp
+	}
+	resp := upload("/docs/a.txt", "/r/upload/docs/a.txt?expiredTime=2h", "first", map[string]string{
+		"Content-Type":        "text/plain; charset=utf-8",
+		"Content-Disposition": `attachment; filename="C:\\tmp\\local name.txt"`,
+	})
+	if resp.Status != ERR_OK || resp.Msg != "OK" {
+		t.Fatalf("upload: %+v", resp.ErrInfo)
+	}
+	f := resp.File
+	if f.Size != 5 || f.ContentType != "text/plain; charset=utf-8" || f.FileName != "local name.txt" || f.Uploader != "192.0.2.1" {
+		t.Errorf("FileInfo %+v", f)
+	}
+	if f.ExpiredTime == nil || f.ExpiredTime.Sub(f.CreateTime) != 2*time.Hour {
+		t.Errorf("ExpiredTime %v, CreateTime %v", f.ExpiredTime, f.CreateTime)
+	}
+	if !strings.HasSuffix(f.DownloadPath, "/r/download/docs/a.txt") {
+		t.Errorf("DownloadPath %s", f.DownloadPath)
+	}
+	if stored, err := getFileInfo("/docs/a.txt"); err != nil || stored == nil || stored.Md5 != f.Md5 {
+		t.Errorf("record %+v, %v", stored, err)
+	}
+
+	// replaceIfExist=false keeps the file, from the query or from the header
+	for _, tt := range []struct {
+		target string
+		header map[string]string
+	}{
+		{"/r/upload/docs/a.txt?replaceIfExist=false", nil},
+		{"/r/upload/docs/a.txt", map[string]string{"X-Replace-If-Exist": "false"}},
+	} {
+		if resp := upload("/docs/a.txt", tt.target, "second", tt.header); resp.Msg != "file exist" {
+			t.Errorf("%s %v: %+v", tt.target, tt.header, resp.ErrInfo)
+		}
+	}
+	if got := readStored(t, "/docs/a.txt"); got != "first" {
+		t.Errorf("kept %q", got)
+	}
+	// a query parameter goes before its header
+	resp = upload("/docs/a.txt", "/r/upload/docs/a.txt?expiredTime=never", "second", map[string]string{"X-Expired-Time": "1h"})
+	if resp.Status != ERR_OK || resp.File.ExpiredTime != nil || readStored(t, "/docs/a.txt") != "second" {
+		t.Errorf("replace: %+v", resp)
+	}
+	resp = upload("/docs/b.txt", "/r/upload/docs/b.txt", "third", map[string]string{"X-Expired-At": "2030-01-01T00:00:00Z"})
+	if resp.Status != ERR_OK || resp.File.ExpiredTime == nil || resp.File.ExpiredTime.Year() != 2030 {
+		t.Errorf("X-Expired-At: %+v", resp)
+	}
+
+	for _, tt := range []struct {
+		reqPath string
+		target  string
+		header  map[string]string
+		want    ErrCode
+	}{
+		{"/docs", "/r/upload/docs", nil, ERR_FILE_EXIST_DIR},
+		{"/c.txt", "/r/upload/c.txt?expiredTime=soon", nil, ERR_REQ_PARAMETER_EXPIRE},
+		{"/c.txt", "/r/upload/c.txt?expiredTime=1h&expiredAt=never", nil, ERR_REQ_PARAMETER_EXPIRE},
+		{"/c.txt", "/r/upload/c.txt", map[string]string{"X-Checksum-Sha256": "00"}, ERR_REQ_PARAMETER_CHECKSUM},
+		{"/c.txt", "/r/upload/c.txt", map[string]string{"X-Meta-Bad Key": "x"}, ERR_REQ_PARAMETER_META},
+	} {
+		if resp := upload(tt.reqPath, tt.target, "content", tt.header); resp.Status != tt.want {
+			t.Errorf("%s %v: %+v, want %d", tt.target, tt.header, resp.ErrInfo, tt.want)
+		}
+	}
+	if fileInfo, err := getFileInfo("/c.txt"); err != nil || fileInfo != nil {
+		t.Errorf("rejected upload is recorded: %+v, %v", fileInfo, err)
+	}
+}
+
+// brokenBody is a request body whose connection breaks after what it has read.
+type brokenBody struct {
+	io.Reader
+}
+
+func (b brokenBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		err = errors.New("connection reset by peer")
+	}
+	return n, err
+}
+
+func TestUploadIsAtomic(t *testing.T) {
+	testServer(t)
+	first := storeFile(t, "/a.txt", "first", nil)
+	stageFiles := func() []string {
+		files, err := filepath.Glob(filepath.Join(svr.dataDir, TMP_DIR, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+	wrong := strings.Repeat("0", 64)
+	tests := []struct {
+		name string
+		body io.Reader
+		sum  string
+		want ErrCode
+	}{
+		{"checksum mismatch", strings.NewReader("second"), wrong, ERR_CHECKSUM_MISMATCH},
+		{"broken connection", brokenBody{strings.NewReader("second")}, "", ERR_HTTP_GET_CONTENT},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("PUT", "/r/upload/a.txt", tt.body)
+		if tt.sum != "" {
+			r.Header.Set("X-Checksum-Sha256", tt.sum)
+		}
+		var resp UploadResponseInfo
+		decodeJSON(t, call(uploadRaw, r, httprouter.Param{Key: "filepath", Value: "/a.txt"}), &resp)
+		if resp.Status != tt.want {
+			t.Errorf("%s: %+v, want %d", tt.name, resp.ErrInfo, tt.want)
+		}
+		if got := readStored(t, "/a.txt"); got != "first" {
+			t.Errorf("%s: the file is %q", tt.name, got)
+		}
+		if fileInfo, err := getFileInfo("/a.txt"); err != nil || fileInfo == nil || fileInfo.Md5 != first.Md5 {
+			t.Errorf("%s: the record is %+v, %v", tt.name, fileInfo, err)
+		}
+		if files := stageFiles(); len(files) != 0 {
+			t.Errorf("%s: staging files are left: %v", tt.name, files)
+		}
+	}
+}
+
+func TestCreateStageFile(t *testing.T) {
+	testServer(t)
+	f, err := createStageFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// the mode of os.Create, which the published file keeps
+	created, err := os.Create(filepath.Join(t.TempDir(), "created"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created.Close()
+	st, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.Stat(created.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode() != want.Mode() {
+		t.Errorf("mode %v, want %v", st.Mode(), want.Mode())
+	}
+	if filepath.Dir(f.Name()) != filepath.Join(svr.dataDir, TMP_DIR) || !strings.HasPrefix(filepath.Base(f.Name()), "stage-") {
+		t.Errorf("staging file %s", f.Name())
+	}
+
+	// a crash leaves staging files behind, they are removed once they are older than uploadSessionTimeout
+	svr.uploadSessionTimeout = time.Hour
+	stale, err := createStageFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(stale.Name(), old, old); err != nil {
+		t.Fatal(err)
+	}
+	deleteStaleStageFiles()
+	if _, err := os.Stat(stale.Name()); !os.IsNotExist(err) {
+		t.Errorf("stale staging file: %v", err)
+	}
+	if _, err := os.Stat(f.Name()); err != nil {
+		t.Errorf("fresh staging file: %v", err)
+	}
+}
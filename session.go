@@ -0,0 +1,516 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"repo/log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadSession is the state of a resumable upload, it is saved in the uploadSession bucket.
+type UploadSession struct {
+	ID              string
+	Dest            string
+	Size            int64 `json:",omitempty"` // total size declared by client, 0 if unknown
+	Offset          int64
+	ExpiredDuration time.Duration
+	ExpiredAt       *time.Time `json:",omitempty"` // replaces ExpiredDuration if set
+	NeverExpire     bool       `json:",omitempty"`
+	ReplaceIfExist  bool
+	CreateTime      time.Time
+	UpdateTime      time.Time
+	Checksums       map[string][]byte `json:",omitempty"` // expected digests declared by the client
+	DigestState     map[string][]byte `json:",omitempty"` // marshaled digests of the first Offset bytes
+	Meta            map[string]string `json:",omitempty"`
+	Tags            []string          `json:",omitempty"`
+	ContentType     string            `json:",omitempty"` // declared by the client, sniffed if empty
+	FileName        string            `json:",omitempty"`
+	Uploader        string            `json:",omitempty"`
+}
+type UploadSessionResponse struct {
+	ErrInfo
+	Session *UploadSession `json:",omitempty"`
+}
+
+var sessionLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// lockSession serializes requests on the same upload session, call the returned func to unlock.
+func lockSession(id string) func() {
+	sessionLocks.Lock()
+	l, ok := sessionLocks.m[id]
+	if !ok {
+		l = &sync.Mutex{}
+		sessionLocks.m[id] = l
+	}
+	sessionLocks.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func forgetSessionLock(id string) {
+	sessionLocks.Lock()
+	delete(sessionLocks.m, id)
+	sessionLocks.Unlock()
+}
+
+func sessionDataPath(id string) string {
+	return path.Join(svr.dataDir, TMP_DIR, "upload-"+id)
+}
+
+// sessionDigester resumes the digests of the data received by session.
+func sessionDigester(session *UploadSession) (digester, error) {
+	digests := newDigester(session.Checksums)
+	if session.Offset == 0 {
+		return digests, nil
+	}
+	if err := digests.Restore(session.DigestState); err != nil {
+		return nil, err
+	}
+	if _, ok := digests["md5"]; !ok {
+		return nil, fmt.Errorf("upload session %s has no md5 state", session.ID)
+	}
+	return digests, nil
+}
+
+func getSession(id string) (*UploadSession, error) {
+	var session *UploadSession
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("uploadSession"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		session = &UploadSession{}
+		return json.Unmarshal(v, session)
+	})
+	return session, err
+}
+
+func putSession(session *UploadSession) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("uploadSession"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		encoded, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(session.ID), encoded)
+	})
+}
+
+// deleteSession removes both the session record and its partial data.
+func deleteSession(id string) {
+	if err := os.Remove(sessionDataPath(id)); err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("uploadSession"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		return b.Delete([]byte(id))
+	})
+	if err != nil {
+		log.Error(err)
+	}
+	forgetSessionLock(id)
+}
+
+/*
+Create a resumable upload session
+curl -F dest=/jianwang/big.iso -F size=4294967296 -F expiredTime=2h -F replaceIfExist=true "http://localhost:50010/r/uploads/"
+expiredAt and "never", metadata and tags, contentType and filename work the same way as upload
+Expected digests can be declared here or when finishing, with X-Checksum-<Algo> headers or <algo> fields like upload
+Return value:
+{"Status":0,"Msg":"OK","Session":{"ID":"9a1f...","Dest":"/jianwang/big.iso","Size":4294967296,"Offset":0,...}}
+*/
+func createUploadSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	r.ParseMultipartForm(32 << 20)
+	exp, err := parseExpiry(valuesGetDefault(r.Form, "expiredTime", ""), valuesGetDefault(r.Form, "expiredAt", ""),
+		DEFAULT_EXPIRED_TIME)
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_EXPIRE))
+		return
+	}
+	reqPath, err := confineFilePath(valuesGetDefault(r.Form, "dest", ""))
+	if err != nil {
+		writePathError(w, err)
+		return
+	}
+	if !checkRight(w, r, reqPath, RIGHT_WRITE) {
+		return
+	}
+	size, err := strconv.ParseInt(valuesGetDefault(r.Form, "size", "0"), 10, 64)
+	if err != nil || size < 0 {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_SIZE))
+		return
+	}
+	checksums, err := parseChecksums(r.Header, r.Form)
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_CHECKSUM))
+		return
+	}
+	meta, tags, err := parseMeta(r.Header, r.Form)
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_META))
+		return
+	}
+	replaceIfExist := valuesGetDefault(r.Form, "replaceIfExist", "true")
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_OPEN_FILE))
+		return
+	}
+	now := time.Now()
+	session := &UploadSession{
+		ID:              hex.EncodeToString(id),
+		Dest:            reqPath,
+		Size:            size,
+		ExpiredDuration: exp.duration,
+		ExpiredAt:       exp.at,
+		NeverExpire:     exp.never,
+		ReplaceIfExist:  strings.ToLower(replaceIfExist) == "true" || replaceIfExist == "1",
+		Checksums:       checksums,
+		Meta:            meta,
+		Tags:            tags,
+		ContentType:     declaredContentType(valuesGetDefault(r.Form, "contentType", "")),
+		FileName:        cleanFileName(valuesGetDefault(r.Form, "filename", "")),
+		Uploader:        remoteHost(r),
+		CreateTime:      now,
+		UpdateTime:      now,
+	}
+	if err := os.MkdirAll(path.Join(svr.dataDir, TMP_DIR), os.ModePerm); err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_MKDIR))
+		return
+	}
+	f, err := os.OpenFile(sessionDataPath(session.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_OPEN_FILE))
+		return
+	}
+	f.Close()
+	if err := putSession(session); err != nil {
+		log.Error(err)
+		deleteSession(session.ID)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_UPDATE_DB))
+		return
+	}
+	w.Header().Set("Upload-Offset", "0")
+	json.NewEncoder(w).Encode(UploadSessionResponse{ErrInfo: MakeErrInfo(ERR_OK), Session: session})
+}
+
+/*
+Get the current offset of an upload session, the client resumes from it after a dropped connection
+curl http://localhost:50010/r/uploads/9a1f...
+*/
+func getUploadSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	session, err := getSession(ps.ByName("id"))
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	if session == nil {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_UPLOAD_NOT_EXIST))
+		return
+	}
+	if !checkRight(w, r, session.Dest, RIGHT_WRITE) {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	json.NewEncoder(w).Encode(UploadSessionResponse{ErrInfo: MakeErrInfo(ERR_OK), Session: session})
+}
+
+/*
+Upload a chunk at the given offset, the offset must equal the current offset of the session
+A chunk which goes beyond the declared size is rejected as a whole, the offset does not move
+curl -X PATCH -H "Upload-Offset: 0" --data-binary @chunk0 http://localhost:50010/r/uploads/9a1f...
+*/
+func uploadChunk(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s, Upload-Offset: %s", r.Method, r.RequestURI, r.RemoteAddr, r.Header.Get("Upload-Offset"))
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	id := ps.ByName("id")
+	defer lockSession(id)()
+	session, err := getSession(id)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	if session == nil {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_UPLOAD_NOT_EXIST))
+		return
+	}
+	if !checkRight(w, r, session.Dest, RIGHT_WRITE) {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != session.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		json.NewEncoder(w).Encode(UploadSessionResponse{ErrInfo: MakeErrInfo(ERR_UPLOAD_OFFSET), Session: session})
+		return
+	}
+	if session.Size > 0 && r.ContentLength > session.Size-offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		json.NewEncoder(w).Encode(UploadSessionResponse{ErrInfo: MakeErrInfo(ERR_UPLOAD_SIZE_EXCEEDED), Session: session})
+		return
+	}
+	digests, err := sessionDigester(session)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	f, err := os.OpenFile(sessionDataPath(id), os.O_WRONLY, 0666)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_OPEN_FILE))
+		return
+	}
+	defer f.Close()
+	// drop whatever a broken request left behind the saved offset
+	if err := f.Truncate(offset); err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_WRITE_FILE))
+		return
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_WRITE_FILE))
+		return
+	}
+	var body io.Reader = r.Body
+	if session.Size > 0 {
+		// one byte more than fits tells a chunk of unknown length which is too long
+		body = io.LimitReader(r.Body, session.Size-offset+1)
+	}
+	// write the file first, so the digests never see bytes which did not reach the disk
+	n, copyErr := io.Copy(io.MultiWriter(f, digests), body)
+	if session.Size > 0 && offset+n > session.Size {
+		log.Warnf("upload %s: chunk at %d goes beyond size %d", id, offset, session.Size)
+		// the whole chunk is dropped, the session stays at its offset
+		if err := f.Truncate(offset); err != nil {
+			log.Error(err)
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		json.NewEncoder(w).Encode(UploadSessionResponse{ErrInfo: MakeErrInfo(ERR_UPLOAD_SIZE_EXCEEDED), Session: session})
+		return
+	}
+	if copyErr != nil {
+		log.Warnf("upload %s interrupted at %d: %v", id, offset+n, copyErr)
+	}
+	if err := f.Sync(); err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_WRITE_FILE))
+		return
+	}
+	state, err := digests.State()
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_WRITE_FILE))
+		return
+	}
+	session.Offset = offset + n
+	session.DigestState = state
+	session.UpdateTime = time.Now()
+	if err := putSession(session); err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_UPDATE_DB))
+		return
+	}
+	log.Debugf("upload %s: recv %v bytes, offset %v", id, n, session.Offset)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	if copyErr != nil {
+		json.NewEncoder(w).Encode(UploadSessionResponse{ErrInfo: MakeErrInfo(ERR_HTTP_GET_CONTENT), Session: session})
+		return
+	}
+	json.NewEncoder(w).Encode(UploadSessionResponse{ErrInfo: MakeErrInfo(ERR_OK), Session: session})
+}
+
+/*
+Finish an upload session, the uploaded data is moved to dest and its FileInfo is saved
+curl -X PUT http://localhost:50010/r/uploads/9a1f...
+Return value is the same as upload
+*/
+func finishUploadSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	id := ps.ByName("id")
+	defer lockSession(id)()
+	session, err := getSession(id)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	if session == nil {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_UPLOAD_NOT_EXIST))
+		return
+	}
+	if !checkRight(w, r, session.Dest, RIGHT_WRITE) {
+		return
+	}
+	if session.Size > 0 && session.Offset != session.Size {
+		json.NewEncoder(w).Encode(UploadSessionResponse{ErrInfo: MakeErrInfo(ERR_UPLOAD_INCOMPLETE), Session: session})
+		return
+	}
+	checksums, err := parseChecksums(r.Header, r.URL.Query())
+	if err != nil {
+		log.Warn(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_CHECKSUM))
+		return
+	}
+	for algo, sum := range session.Checksums {
+		checksums[algo] = sum
+	}
+	digests, err := sessionDigester(session)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	for algo := range checksums {
+		if _, ok := digests[algo]; !ok {
+			log.Warnf("upload %s: %s is not computed, declare it when creating the session", id, algo)
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_CHECKSUM))
+			return
+		}
+	}
+	if algo, ok := digests.Verify(checksums); !ok {
+		log.Warnf("upload %s: %s checksum mismatch, expected: %x, got: %x", id, algo, checksums[algo], digests[algo].Sum(nil))
+		deleteSession(id)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_CHECKSUM_MISMATCH))
+		return
+	}
+	reqPath := session.Dest
+	localPath := path.Join(svr.dataDir, reqPath)
+	if st, err := os.Stat(localPath); err != nil {
+		if !os.IsNotExist(err) {
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_OPEN_FILE))
+			return
+		}
+	} else {
+		if st.IsDir() {
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_EXIST_DIR))
+			return
+		}
+		if !session.ReplaceIfExist {
+			json.NewEncoder(w).Encode(UploadResponseInfo{ErrInfo: ErrInfo{Status: ERR_OK,
+				Msg: "file exist"}})
+			return
+		}
+	}
+	fileInfo, err := newFileInfo(reqPath, sessionDataPath(id), digests, uploadOptions{
+		expiry:      expiry{duration: session.ExpiredDuration, at: session.ExpiredAt, never: session.NeverExpire},
+		meta:        session.Meta,
+		tags:        session.Tags,
+		contentType: session.ContentType,
+		fileName:    session.FileName,
+		uploader:    session.Uploader,
+	})
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_OPEN_FILE))
+		return
+	}
+	// the session is kept on failure, so the client can retry
+	if errCode := publishFile(sessionDataPath(id), reqPath, fileInfo); errCode != ERR_OK {
+		json.NewEncoder(w).Encode(MakeErrInfo(errCode))
+		return
+	}
+	deleteSession(id)
+	fileInfo.DownloadPath = downloadPath(r, reqPath, nil)
+	json.NewEncoder(w).Encode(UploadResponseInfo{
+		ErrInfo: MakeErrInfo(ERR_OK),
+		File:    *fileInfo,
+	})
+}
+
+/*
+Abort an upload session and discard the uploaded data
+curl -X DELETE http://localhost:50010/r/uploads/9a1f...
+*/
+func abortUploadSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	id := ps.ByName("id")
+	defer lockSession(id)()
+	session, err := getSession(id)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	if session == nil {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_UPLOAD_NOT_EXIST))
+		return
+	}
+	if !checkRight(w, r, session.Dest, RIGHT_WRITE) {
+		return
+	}
+	deleteSession(id)
+	json.NewEncoder(w).Encode(MakeErrInfo(ERR_OK))
+}
+
+// deleteExpiredUploadSessions removes the sessions which have not received any chunk for uploadSessionTimeout.
+func deleteExpiredUploadSessions() {
+	expired := make([]string, 0)
+	deadline := time.Now().Add(-svr.uploadSessionTimeout)
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("uploadSession"))
+		if b == nil {
+			log.Error("DB bucket uploadSession does not exist ")
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			temp := &UploadSession{}
+			if err := json.Unmarshal(v, temp); err != nil {
+				log.Error(err)
+				continue
+			}
+			if temp.UpdateTime.Before(deadline) {
+				expired = append(expired, string(k))
+			}
+		}
+		return nil
+	})
+	for _, id := range expired {
+		unlock := lockSession(id)
+		// a chunk may have arrived after the scan
+		if session, err := getSession(id); err == nil && session != nil && session.UpdateTime.Before(deadline) {
+			log.Debugf("remove expired upload session: %s", id)
+			deleteSession(id)
+		}
+		unlock()
+	}
+}
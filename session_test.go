@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newUploadSession creates an upload session with fields, the test fails unless it is created.
+func newUploadSession(t *testing.T, fields url.Values) *UploadSession {
+	t.Helper()
+	var resp UploadSessionResponse
+	decodeJSON(t, call(createUploadSession, formRequest("POST", "/r/uploads/", fields)), &resp)
+	if resp.Status != ERR_OK || resp.Session == nil {
+		t.Fatalf("create upload session: %+v", resp)
+	}
+	return resp.Session
+}
+
+// sendChunk uploads chunk at offset to session id, it returns the response and its Upload-Offset,
+// -1 if there is none.
+func sendChunk(t *testing.T, id string, offset int64, chunk string) (UploadSessionResponse, int64) {
+	t.Helper()
+	r := httptest.NewRequest("PATCH", "/r/uploads/"+id, strings.NewReader(chunk))
+	r.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w := call(uploadChunk, r, httprouter.Param{Key: "id", Value: id})
+	var resp UploadSessionResponse
+	decodeJSON(t, w, &resp)
+	n, err := strconv.ParseInt(w.Header().Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		n = -1
+	}
+	return resp, n
+}
+
+func finishSession(t *testing.T, id string) UploadResponseInfo {
+	t.Helper()
+	var resp UploadResponseInfo
+	decodeJSON(t, call(finishUploadSession, httptest.NewRequest("PUT", "/r/uploads/"+id, nil),
+		httprouter.Param{Key: "id", Value: id}), &resp)
+	return resp
+}
+
+func TestUploadSession(t *testing.T) {
+	testServer(t)
+	content := "0123456789"
+	session := newUploadSession(t, url.Values{"dest": {"/big/file.bin"}, "size": {"10"}, "expiredTime": {"never"},
+		"meta-build": {"42"}})
+	if _, err := os.Stat(sessionDataPath(session.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if resp, n := sendChunk(t, session.ID, 0, content[:4]); resp.Status != ERR_OK || n != 4 {
+		t.Fatalf("first chunk: %+v, offset %d", resp.ErrInfo, n)
+	}
+	// a chunk at another offset than the one of the session is rejected, the client learns the right one
+	for _, offset := range []int64{0, 2, 6} {
+		if resp, n := sendChunk(t, session.ID, offset, content[offset:]); resp.Status != ERR_UPLOAD_OFFSET || n != 4 {
+			t.Errorf("chunk at %d: %+v, offset %d", offset, resp.ErrInfo, n)
+		}
+	}
+	// beyond the declared size
+	if resp, n := sendChunk(t, session.ID, 4, content[4:]+"x"); resp.Status != ERR_UPLOAD_SIZE_EXCEEDED || n != 4 {
+		t.Errorf("chunk beyond size: %+v, offset %d", resp.ErrInfo, n)
+	}
+	if resp := finishSession(t, session.ID); resp.Status != ERR_UPLOAD_INCOMPLETE {
+		t.Errorf("finish incomplete session: %+v", resp.ErrInfo)
+	}
+
+	// the session and its digests survive a restart
+	db.Close()
+	if _, err := InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	var resp UploadSessionResponse
+	decodeJSON(t, call(getUploadSession, httptest.NewRequest("GET", "/r/uploads/"+session.ID, nil),
+		httprouter.Param{Key: "id", Value: session.ID}), &resp)
+	if resp.Status != ERR_OK || resp.Session.Offset != 4 {
+		t.Fatalf("session after restart: %+v", resp)
+	}
+	if resp, n := sendChunk(t, session.ID, 4, content[4:]); resp.Status != ERR_OK || n != 10 {
+		t.Fatalf("last chunk: %+v, offset %d", resp.ErrInfo, n)
+	}
+
+	finished := finishSession(t, session.ID)
+	if finished.Status != ERR_OK {
+		t.Fatalf("finish: %+v", finished.ErrInfo)
+	}
+	if want := fmt.Sprintf("%x", md5.Sum([]byte(content))); finished.File.Md5 != want {
+		t.Errorf("Md5 %s, want %s", finished.File.Md5, want)
+	}
+	if finished.File.ExpiredTime != nil || finished.File.Meta["build"] != "42" || finished.File.Size != 10 {
+		t.Errorf("FileInfo %+v", finished.File)
+	}
+	if got := readStored(t, "/big/file.bin"); got != content {
+		t.Errorf("stored %q", got)
+	}
+	if s, err := getSession(session.ID); err != nil || s != nil {
+		t.Errorf("session after finish: %+v, %v", s, err)
+	}
+	if _, err := os.Stat(sessionDataPath(session.ID)); !os.IsNotExist(err) {
+		t.Errorf("session data after finish: %v", err)
+	}
+	if resp := finishSession(t, session.ID); resp.Status != ERR_UPLOAD_NOT_EXIST {
+		t.Errorf("finish twice: %+v", resp.ErrInfo)
+	}
+}
+
+func TestUploadSessionChecksum(t *testing.T) {
+	testServer(t)
+	wrong := md5.Sum([]byte("something else"))
+	r := formRequest("POST", "/r/uploads/", url.Values{"dest": {"/a.txt"}})
+	r.Header.Set("X-Checksum-Md5", hex.EncodeToString(wrong[:]))
+	var created UploadSessionResponse
+	decodeJSON(t, call(createUploadSession, r), &created)
+	if created.Status != ERR_OK {
+		t.Fatalf("create: %+v", created.ErrInfo)
+	}
+	id := created.Session.ID
+	// without a declared size any chunk fits
+	if resp, n := sendChunk(t, id, 0, "content"); resp.Status != ERR_OK || n != 7 {
+		t.Fatalf("chunk: %+v, offset %d", resp.ErrInfo, n)
+	}
+	if resp := finishSession(t, id); resp.Status != ERR_CHECKSUM_MISMATCH {
+		t.Fatalf("finish: %+v", resp.ErrInfo)
+	}
+	if s, err := getSession(id); err != nil || s != nil {
+		t.Errorf("session after mismatch: %+v, %v", s, err)
+	}
+	if fileInfo, err := getFileInfo("/a.txt"); err != nil || fileInfo != nil || readStored(t, "/a.txt") != "" {
+		t.Errorf("stored after mismatch: %+v, %v", fileInfo, err)
+	}
+}
+
+func TestDeleteExpiredUploadSessions(t *testing.T) {
+	testServer(t)
+	svr.uploadSessionTimeout = time.Hour
+	idle := newUploadSession(t, url.Values{"dest": {"/idle.bin"}})
+	active := newUploadSession(t, url.Values{"dest": {"/active.bin"}})
+	if resp, _ := sendChunk(t, idle.ID, 0, "abc"); resp.Status != ERR_OK {
+		t.Fatal(resp.ErrInfo)
+	}
+	session, err := getSession(idle.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.UpdateTime = time.Now().Add(-2 * time.Hour)
+	if err := putSession(session); err != nil {
+		t.Fatal(err)
+	}
+	deleteExpiredUploadSessions()
+	if s, err := getSession(idle.ID); err != nil || s != nil {
+		t.Errorf("idle session: %+v, %v", s, err)
+	}
+	if _, err := os.Stat(sessionDataPath(idle.ID)); !os.IsNotExist(err) {
+		t.Errorf("data of the idle session: %v", err)
+	}
+	if s, err := getSession(active.ID); err != nil || s == nil {
+		t.Errorf("active session: %+v, %v", s, err)
+	}
+	if resp, _ := sendChunk(t, idle.ID, 3, "def"); resp.Status != ERR_UPLOAD_NOT_EXIST {
+		t.Errorf("chunk of the removed session: %+v", resp.ErrInfo)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"repo/httpgzip"
+	"repo/log"
+	"time"
+)
+
+// GZIP_DIR is the directory under dataDir which holds the gzip compressed sidecars of stored files,
+// keyed by sha256 like the blobs, so copies and versions of a content share one.
+const GZIP_DIR = ".gzip"
+
+// files smaller than this are not worth a sidecar
+const MIN_GZIP_SIZE = 1024
+
+// paths waiting for a sidecar, the ones which don't fit are picked up by the periodic sweep
+var gzipQueue = make(chan string, 1024)
+
+func gzipSidecarPath(sum string) string {
+	return path.Join(svr.dataDir, GZIP_DIR, sum[:2], sum+".gz")
+}
+
+// needsGzipSidecar reports whether a sidecar of fileInfo should be tried.
+func needsGzipSidecar(fileInfo *FileInfo) bool {
+	return fileInfo.Digests["sha256"] != "" && fileInfo.GzipSize == 0 && !fileInfo.NotWorthGzip &&
+		fileInfo.Size >= MIN_GZIP_SIZE && (svr.gzipMaxSize <= 0 || fileInfo.Size <= svr.gzipMaxSize) &&
+		!httpgzip.IsCompressedType(fileInfo.ContentType)
+}
+
+// queueGzipSidecar asks the sidecar worker for a sidecar of reqPath, which is just stored as fileInfo.
+func queueGzipSidecar(reqPath string, fileInfo *FileInfo) {
+	if !svr.gzipSidecars || !needsGzipSidecar(fileInfo) {
+		return
+	}
+	select {
+	case gzipQueue <- reqPath:
+	default:
+	}
+}
+
+func gzipSidecarWorker() {
+	for reqPath := range gzipQueue {
+		makeGzipSidecar(reqPath)
+	}
+}
+
+// makeGzipSidecar compresses reqPath into its sidecar and records in its FileInfo the size of the sidecar,
+// or that gzip does not make it smaller.
+func makeGzipSidecar(reqPath string) {
+	fileInfo, err := getFileInfo(reqPath)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if fileInfo == nil || !needsGzipSidecar(fileInfo) {
+		return
+	}
+	sum := fileInfo.Digests["sha256"]
+	gzSize, err := writeGzipSidecar(path.Join(svr.dataDir, reqPath), sum)
+	if err != nil {
+		log.Warnf("gzip sidecar of %s: %v", reqPath, err)
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileInfo"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		v := b.Get([]byte(reqPath))
+		if v == nil {
+			return nil
+		}
+		current := &FileInfo{}
+		if err := json.Unmarshal(v, current); err != nil {
+			return err
+		}
+		// the file has been replaced meanwhile
+		if current.Digests["sha256"] != sum {
+			return nil
+		}
+		current.GzipSize = gzSize
+		current.NotWorthGzip = gzSize == 0
+		encoded, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+		log.Debugf("Write DB: %s: %s", reqPath, string(encoded))
+		return b.Put([]byte(reqPath), encoded)
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// writeGzipSidecar compresses localPath into the sidecar of sum unless it is there already,
+// it returns the size of the sidecar, 0 if gzip does not make the content smaller.
+func writeGzipSidecar(localPath, sum string) (int64, error) {
+	sp := gzipSidecarPath(sum)
+	if st, err := os.Stat(sp); err == nil {
+		return st.Size(), nil
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	stage, err := createStageFile()
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(stage.Name())
+	defer stage.Close()
+	gw := gzip.NewWriter(stage)
+	n, err := io.Copy(gw, f)
+	if err != nil {
+		return 0, err
+	}
+	if err := gw.Close(); err != nil {
+		return 0, err
+	}
+	st, err := stage.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if st.Size() >= n {
+		return 0, nil
+	}
+	if err := os.MkdirAll(path.Dir(sp), os.ModePerm); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(stage.Name(), sp); err != nil {
+		return 0, err
+	}
+	log.Debugf("gzip sidecar: %s, %d -> %d bytes", sp, n, st.Size())
+	return st.Size(), nil
+}
+
+// queueGzipSidecars queues the stored files which have no sidecar yet, those of earlier uploads
+// and the ones which didn't fit in the queue.
+func queueGzipSidecars() {
+	if !svr.gzipSidecars {
+		return
+	}
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileInfo"))
+		if b == nil {
+			log.Error("DB bucket fileInfo does not exist ")
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			fileInfo := &FileInfo{}
+			if err := json.Unmarshal(v, fileInfo); err != nil {
+				log.Errorf("%s: %v", k, err)
+				return nil
+			}
+			queueGzipSidecar(string(k), fileInfo)
+			return nil
+		})
+	})
+}
+
+// deleteUnusedGzipSidecars removes the sidecars which no stored file or kept version has the content of.
+// Sidecars younger than an hour stay, their records may not be written yet.
+func deleteUnusedGzipSidecars() {
+	sidecars, err := filepath.Glob(path.Join(svr.dataDir, GZIP_DIR, "*", "*.gz"))
+	if err != nil || len(sidecars) == 0 {
+		return
+	}
+	used := make(map[string]bool)
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{"fileInfo", "fileVersions"} {
+			b := tx.Bucket([]byte(name))
+			if b == nil {
+				return fmt.Errorf("read db error")
+			}
+			err := b.ForEach(func(k, v []byte) error {
+				fileInfo := &FileInfo{}
+				if err := json.Unmarshal(v, fileInfo); err == nil {
+					used[fileInfo.Digests["sha256"]] = true
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	deadline := time.Now().Add(-time.Hour)
+	for _, sp := range sidecars {
+		sum := path.Base(sp)
+		sum = sum[:len(sum)-len(".gz")]
+		if st, err := os.Stat(sp); err != nil || used[sum] || st.ModTime().After(deadline) {
+			continue
+		}
+		log.Debugf("remove gzip sidecar: %s", sp)
+		if err := os.Remove(sp); err != nil {
+			log.Error(err)
+		}
+		os.Remove(path.Dir(sp))
+	}
+}
+
+// sidecarFile serves the gzip sidecar of its content to the clients which accept gzip.
+type sidecarFile struct {
+	*os.File
+	sidecar string
+}
+
+// GzipFile opens the sidecar, nil if it is gone, then the content is compressed on the fly.
+func (f sidecarFile) GzipFile() http.File {
+	sidecar, err := os.Open(f.sidecar)
+	if err != nil {
+		log.Warn(err)
+		return nil
+	}
+	return sidecar
+}
+
+// notWorthGzipFile is a file which gzip did not make smaller.
+type notWorthGzipFile struct {
+	*os.File
+}
+
+func (notWorthGzipFile) NotWorthGzipCompressing() {}
+
+// gzipVariant wraps f, the content of fileInfo, by what is known of its compression.
+func gzipVariant(r *http.Request, f *os.File, fileInfo *FileInfo) io.ReadSeeker {
+	if fileInfo.NotWorthGzip {
+		return notWorthGzipFile{f}
+	}
+	if sum := fileInfo.Digests["sha256"]; sum != "" && httpgzip.AcceptsGzip(r) {
+		if sp := gzipSidecarPath(sum); checkFileIsExist(sp) {
+			return sidecarFile{f, sp}
+		}
+	}
+	return f
+}
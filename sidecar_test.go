@@ -0,0 +1,59 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipSidecar(t *testing.T) {
+	testServer(t)
+	svr.gzipSidecars = true
+	t.Cleanup(func() {
+		// nothing works through the queue, the uploads of the test are left in it
+		for len(gzipQueue) > 0 {
+			<-gzipQueue
+		}
+	})
+	svr.digests = []string{"sha256"}
+	content := strings.Repeat("compressible text ", 200)
+	storeFile(t, "/a.txt", content, nil)
+	storeFile(t, "/copy.txt", content, nil)
+	storeFile(t, "/small.txt", "small", nil)
+	for _, reqPath := range []string{"/a.txt", "/copy.txt", "/small.txt"} {
+		makeGzipSidecar(reqPath)
+	}
+	fileInfo, _ := getFileInfo("/a.txt")
+	if fileInfo.GzipSize == 0 || fileInfo.GzipSize >= fileInfo.Size || !checkFileIsExist(gzipSidecarPath(fileInfo.Digests["sha256"])) {
+		t.Fatalf("sidecar: %+v", fileInfo)
+	}
+	if small, _ := getFileInfo("/small.txt"); small.GzipSize != 0 || needsGzipSidecar(small) {
+		t.Errorf("sidecar of a small file: %+v", small)
+	}
+
+	r := httptest.NewRequest("GET", "/r/download/copy.txt", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := call(download, r, httprouter.Param{Key: "filepath", Value: "/copy.txt"})
+	if w.Header().Get("Content-Encoding") != "gzip" || int64(w.Body.Len()) != fileInfo.GzipSize {
+		t.Fatalf("download: %v, %d bytes", w.Header(), w.Body.Len())
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(gr); err != nil || string(b) != content {
+		t.Errorf("decoded %d bytes, %v", len(b), err)
+	}
+
+	// sidecars are shared by sha256, without it there are none
+	svr.digests = nil
+	if computesDigest("sha256") || !computesDigest("md5") {
+		t.Error("computesDigest")
+	}
+	if b := storeFile(t, "/b.txt", content+"b", nil); needsGzipSidecar(&b) {
+		t.Errorf("a sidecar without sha256: %+v", b)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"repo/log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_SIGN_TIME = "1h"
+	// the query parameters of a signed URL
+	SIGN_EXPIRES  = "sigExpires"
+	SIGN_MAX_SIZE = "sigMaxSize"
+	SIGNATURE     = "signature"
+)
+
+// signKey is the HMAC key of -signKeyFile, URLs can't be signed without it.
+var signKey []byte
+
+// SignResponseInfo is the response of /r/sign.
+type SignResponseInfo struct {
+	ErrInfo
+	URL     string
+	Expires time.Time
+}
+
+func loadSignKey(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	key := strings.TrimSpace(string(b))
+	if len(key) < 16 {
+		return fmt.Errorf("%s: sign key is shorter than 16 characters", file)
+	}
+	signKey = []byte(key)
+	return nil
+}
+
+// urlSignature signs method, path and every query parameter but the signature itself.
+func urlSignature(method, urlPath string, query url.Values) string {
+	q := url.Values{}
+	for k, v := range query {
+		if k != SIGNATURE {
+			q[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, signKey)
+	// Encode sorts by key
+	fmt.Fprintf(mac, "%s\n%s\n%s", method, urlPath, q.Encode())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL returns the path and query of a URL for method on urlPath which is valid until expires,
+// query is signed along with them.
+func signURL(method, urlPath string, query url.Values, expires time.Time) string {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set(SIGN_EXPIRES, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(SIGNATURE, urlSignature(method, urlPath, q))
+	return urlPath + "?" + q.Encode()
+}
+
+// isSigned reports whether r is made with a signed URL.
+func isSigned(r *http.Request) bool {
+	return r.URL.Query().Get(SIGNATURE) != ""
+}
+
+// verifySignature checks the signature and expiry of a signed URL, it returns the token which the URL
+// stands for: read right on reqPath for GET, write right for PUT, and on nothing below reqPath.
+func verifySignature(r *http.Request, reqPath string) (*Token, error) {
+	if signKey == nil {
+		return nil, fmt.Errorf("signed URL without -signKeyFile")
+	}
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get(SIGN_EXPIRES), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %q", SIGN_EXPIRES, query.Get(SIGN_EXPIRES))
+	}
+	method := r.Method
+	if method == "HEAD" {
+		method = "GET"
+	}
+	expected := urlSignature(method, r.URL.Path, query)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(SIGNATURE))) {
+		return nil, fmt.Errorf("signature mismatch")
+	}
+	if time.Now().Unix() > expires {
+		return nil, fmt.Errorf("signed URL expired at %s", time.Unix(expires, 0).Format(time.RFC3339))
+	}
+	right := "read"
+	if method != "GET" {
+		right = "write"
+	}
+	return &Token{ID: "signed", Name: "signed URL", Scopes: []string{right + ":" + reqPath}, exact: true}, nil
+}
+
+// limitSignedBody applies the max size of a signed upload URL to the body of r, it writes the 413
+// response and returns false if the body is declared larger.
+func limitSignedBody(w http.ResponseWriter, r *http.Request) bool {
+	v := r.URL.Query().Get(SIGN_MAX_SIZE)
+	if v == "" {
+		return true
+	}
+	maxSize, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || r.ContentLength > maxSize {
+		writeAuthError(w, http.StatusRequestEntityTooLarge, ERR_UPLOAD_TOO_LARGE)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	return true
+}
+
+// downloadPath returns the URL of reqPath, query is added to it. If the request asks for it with
+// signDownload=<duration> and a sign key is loaded, it is a signed URL valid for that long.
+func downloadPath(r *http.Request, reqPath string, query url.Values) string {
+	urlPath := "/r/download" + reqPath
+	v := r.URL.Query().Get("signDownload")
+	if v == "" && r.Form != nil {
+		v = r.Form.Get("signDownload")
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 && signKey != nil {
+		return requestScheme(r) + "://" + r.Host + signURL("GET", urlPath, query, time.Now().Add(d))
+	}
+	if len(query) > 0 {
+		urlPath += "?" + query.Encode()
+	}
+	return requestScheme(r) + "://" + r.Host + urlPath
+}
+
+/*
+Sign a URL which downloads or uploads one path until it expires, without a token
+curl -H "Authorization: Bearer $TOKEN" -F method=GET -F expiresIn=24h "http://localhost:50010/r/sign/release/app.tar.gz"
+curl -H "Authorization: Bearer $TOKEN" -F method=PUT -F expiresIn=2h -F maxSize=104857600 -F expiredTime=720h "http://localhost:50010/r/sign/release/app.tar.gz"
+Return value:
+{"Status":0,"Msg":"OK","URL":"http://localhost:50010/r/download/release/app.tar.gz?sigExpires=1502791399&signature=5d3c...","Expires":"..."}
+GET URLs download the path, PUT URLs upload it with curl -T, maxSize, expiredTime or expiredAt and replaceIfExist
+of a PUT URL are part of its signature, the option headers of upload are ignored, so it can't extract an archive either.
+The token needs read right on the path for GET and write right for PUT.
+*/
+func signFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if signKey == nil {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_SIGN_NOT_CONFIGURED))
+		return
+	}
+	r.ParseMultipartForm(32 << 20)
+	reqPath := ps.ByName("filepath")
+	expiresIn, err := time.ParseDuration(valuesGetDefault(r.Form, "expiresIn", DEFAULT_SIGN_TIME))
+	if err != nil || expiresIn <= 0 {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_EXPIRE))
+		return
+	}
+	query := url.Values{}
+	var urlPath string
+	method := strings.ToUpper(valuesGetDefault(r.Form, "method", "GET"))
+	switch method {
+	case "GET":
+		urlPath = "/r/download" + reqPath
+	case "PUT":
+		if !checkRight(w, r, reqPath, RIGHT_WRITE) {
+			return
+		}
+		urlPath = "/r/upload" + reqPath
+		if v := valuesGetDefault(r.Form, "maxSize", ""); v != "" {
+			if maxSize, err := strconv.ParseInt(v, 10, 64); err != nil || maxSize < 0 {
+				json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_SIZE))
+				return
+			}
+			query.Set(SIGN_MAX_SIZE, v)
+		}
+		expiredTime, expiredAt := valuesGetDefault(r.Form, "expiredTime", ""), valuesGetDefault(r.Form, "expiredAt", "")
+		if _, err := parseExpiry(expiredTime, expiredAt, DEFAULT_EXPIRED_TIME); err != nil {
+			log.Warn(err)
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_EXPIRE))
+			return
+		}
+		for k, v := range map[string]string{"expiredTime": expiredTime, "expiredAt": expiredAt,
+			"replaceIfExist": valuesGetDefault(r.Form, "replaceIfExist", "")} {
+			if v != "" {
+				query.Set(k, v)
+			}
+		}
+	default:
+		log.Warnf("can't sign method %s", method)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_METHOD))
+		return
+	}
+	// the URL carries whole seconds
+	expires := time.Unix(time.Now().Add(expiresIn).Unix(), 0)
+	json.NewEncoder(w).Encode(SignResponseInfo{
+		ErrInfo: MakeErrInfo(ERR_OK),
+		URL:     requestScheme(r) + "://" + r.Host + signURL(method, urlPath, query, expires),
+		Expires: expires,
+	})
+}
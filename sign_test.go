@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	defer func(key []byte) { signKey = key }(signKey)
+	signKey = []byte("0123456789abcdef")
+	future := time.Now().Add(time.Hour)
+	get := signURL("GET", "/r/download/release/app.tgz", nil, future)
+	put := signURL("PUT", "/r/upload/release/app.tgz", url.Values{SIGN_MAX_SIZE: {"100"}, "expiredTime": {"2h"}}, future)
+	tamper := func(u, k, v string) string {
+		parsed, _ := url.Parse(u)
+		q := parsed.Query()
+		q.Set(k, v)
+		return parsed.Path + "?" + q.Encode()
+	}
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		reqPath string
+		right   string // scope of the token, "" if the URL is rejected
+	}{
+		{"get", "GET", get, "/release/app.tgz", "read:/release/app.tgz"},
+		{"head is get", "HEAD", get, "/release/app.tgz", "read:/release/app.tgz"},
+		{"put", "PUT", put, "/release/app.tgz", "write:/release/app.tgz"},
+		{"get url used to put", "PUT", strings.Replace(get, "/r/download/", "/r/upload/", 1), "/release/app.tgz", ""},
+		{"put url used to get", "GET", put, "/release/app.tgz", ""},
+		{"other path", "GET", strings.Replace(get, "app.tgz", "other.tgz", 1), "/release/other.tgz", ""},
+		{"tampered max size", "PUT", tamper(put, SIGN_MAX_SIZE, "100000"), "/release/app.tgz", ""},
+		{"tampered expiry", "GET", tamper(get, SIGN_EXPIRES, "99999999999"), "/release/app.tgz", ""},
+		{"added option", "PUT", tamper(put, "replaceIfExist", "false"), "/release/app.tgz", ""},
+		{"no expiry", "GET", "/r/download/release/app.tgz?signature=00", "/release/app.tgz", ""},
+		{"bad signature", "GET", tamper(get, SIGNATURE, strings.Repeat("0", 64)), "/release/app.tgz", ""},
+		{"expired", "GET", signURL("GET", "/r/download/release/app.tgz", nil, time.Now().Add(-time.Second)), "/release/app.tgz", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if !isSigned(r) {
+			t.Errorf("%s: not signed", tt.name)
+			continue
+		}
+		token, err := verifySignature(r, tt.reqPath)
+		if tt.right == "" {
+			if err == nil {
+				t.Errorf("%s: accepted", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(token.Scopes) != 1 || token.Scopes[0] != tt.right {
+			t.Errorf("%s: scopes %v, want %s", tt.name, token.Scopes, tt.right)
+		}
+		// a signed URL is good for its path only
+		if token.allows(tt.reqPath+"/index.html", RIGHT_READ) || token.allows("/release", RIGHT_READ) {
+			t.Errorf("%s: allowed on another path", tt.name)
+		}
+	}
+	signKey = []byte("another key of the server")
+	if _, err := verifySignature(httptest.NewRequest("GET", get, nil), "/release/app.tgz"); err == nil {
+		t.Error("accepted with another key")
+	}
+	signKey = nil
+	if _, err := verifySignature(httptest.NewRequest("GET", get, nil), "/release/app.tgz"); err == nil {
+		t.Error("accepted without a key")
+	}
+}
+
+func TestSignedUploadIgnoresOptionHeaders(t *testing.T) {
+	testServer(t)
+	defer func(key []byte) { signKey = key }(signKey)
+	signKey = []byte("0123456789abcdef")
+	h := confinedFile(authorized(RIGHT_WRITE, uploadRaw))
+	upload := func(target string, body []byte, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", target, bytes.NewReader(body))
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h(w, r, httprouter.Params{{Key: "filepath", Value: strings.TrimPrefix(r.URL.Path, "/r/upload")}})
+		return w
+	}
+	// a zip of one entry
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	if f, err := zw.Create("evil.txt"); err != nil {
+		t.Fatal(err)
+	} else {
+		f.Write([]byte("x"))
+	}
+	zw.Close()
+	target := signURL("PUT", "/r/upload/drop/app.zip", url.Values{"replaceIfExist": {"false"}}, time.Now().Add(time.Hour))
+	header := http.Header{"X-Extract": {"auto"}, "X-Expired-Time": {"never"}}
+	if w := upload(target, zipped.Bytes(), header); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Status":0`) {
+		t.Fatalf("signed upload: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(path.Join(svr.dataDir, "drop/app.zip/evil.txt")); err == nil {
+		t.Fatal("the archive is extracted")
+	}
+	fileInfo, err := getFileInfo("/drop/app.zip")
+	if err != nil || fileInfo == nil || fileInfo.Size != int64(zipped.Len()) {
+		t.Fatalf("the archive is not stored as a file: %v %v", fileInfo, err)
+	}
+	if fileInfo.ExpiredTime == nil {
+		t.Fatal("X-Expired-Time: never is applied")
+	}
+	// replaceIfExist=false of the signed query holds against the header
+	header = http.Header{"X-Replace-If-Exist": {"true"}}
+	if w := upload(target, []byte("replaced"), header); !strings.Contains(w.Body.String(), "file exist") {
+		t.Fatalf("replaced: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"repo/log"
+	"sync"
+	"syscall"
+)
+
+// serverTLS holds what -tlsCert, -tlsKey, -tlsClientCA and -clientCertFile load, they are reloaded on SIGHUP.
+var serverTLS struct {
+	sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// tokens of client certificates by subject
+	subjects map[string]*Token
+}
+
+// loadTLS loads the certificate, the client CAs and the client subjects, nothing is replaced if one fails.
+func loadTLS() error {
+	if svr.tlsKey == "" {
+		return fmt.Errorf("-tlsCert needs -tlsKey")
+	}
+	cert, err := tls.LoadX509KeyPair(svr.tlsCert, svr.tlsKey)
+	if err != nil {
+		return err
+	}
+	if svr.requireClientCert && svr.tlsClientCA == "" {
+		return fmt.Errorf("-requireClientCert needs -tlsClientCA")
+	}
+	var clientCAs *x509.CertPool
+	if svr.tlsClientCA != "" {
+		pem, err := ioutil.ReadFile(svr.tlsClientCA)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificate found", svr.tlsClientCA)
+		}
+	}
+	var subjects map[string]*Token
+	if svr.clientCertFile != "" {
+		if clientCAs == nil {
+			return fmt.Errorf("-clientCertFile needs -tlsClientCA")
+		}
+		// the scopes of a subject are checked like the ones of a token, which only happens with -auth
+		if !svr.auth {
+			return fmt.Errorf("-clientCertFile needs -auth")
+		}
+		if subjects, err = loadClientCertFile(svr.clientCertFile); err != nil {
+			return err
+		}
+	}
+	serverTLS.Lock()
+	serverTLS.cert = &cert
+	serverTLS.clientCAs = clientCAs
+	serverTLS.subjects = subjects
+	serverTLS.Unlock()
+	log.Infof("loaded TLS certificate %s, %d client subjects", svr.tlsCert, len(subjects))
+	return nil
+}
+
+// loadClientCertFile loads a JSON array of client certificate subjects and their scopes,
+// like [{"Subject":"CN=ci,O=example","Scopes":["write:/release"]}]. A subject without "="
+// is matched against the common name only.
+func loadClientCertFile(file string) (map[string]*Token, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Subject string
+		Scopes  []string
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	subjects := make(map[string]*Token, len(entries))
+	for _, e := range entries {
+		if e.Subject == "" {
+			return nil, fmt.Errorf("%s: empty subject", file)
+		}
+		for _, scope := range e.Scopes {
+			if _, _, err := parseScope(scope); err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+		}
+		subjects[e.Subject] = &Token{ID: "cert-" + e.Subject, Name: e.Subject, Scopes: e.Scopes}
+	}
+	return subjects, nil
+}
+
+// certToken returns the token of the verified client certificate of r, nil if there is none.
+func certToken(r *http.Request) *Token {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	serverTLS.RLock()
+	defer serverTLS.RUnlock()
+	if token := serverTLS.subjects[cert.Subject.String()]; token != nil {
+		return token
+	}
+	return serverTLS.subjects[cert.Subject.CommonName]
+}
+
+// newTLSConfig returns the TLS config of the server, every handshake takes the certificate
+// and the client CAs loaded last.
+func newTLSConfig() *tls.Config {
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		serverTLS.RLock()
+		defer serverTLS.RUnlock()
+		return serverTLS.cert, nil
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			serverTLS.RLock()
+			defer serverTLS.RUnlock()
+			config := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: getCertificate,
+				NextProtos:     []string{"h2", "http/1.1"},
+			}
+			if serverTLS.clientCAs != nil {
+				config.ClientCAs = serverTLS.clientCAs
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				if svr.requireClientCert {
+					config.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return config, nil
+		},
+	}
+}
+
+// reloadTLSOnSIGHUP reloads the certificate, the client CAs and the client subjects on SIGHUP,
+// the ones loaded before stay if they fail to load.
+func reloadTLSOnSIGHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := loadTLS(); err != nil {
+			log.Errorf("reload TLS: %v", err)
+		}
+	}
+}
+
+// requestScheme returns the scheme of the URLs which point back to the server.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
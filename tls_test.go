@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate of cn and its key into temporary PEM files.
+func writeTestCert(t *testing.T, cn string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = writeFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile = writeFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+func TestLoadTLS(t *testing.T) {
+	testServer(t)
+	defer func() {
+		serverTLS.cert, serverTLS.clientCAs, serverTLS.subjects = nil, nil, nil
+	}()
+	cert, key := writeTestCert(t, "localhost")
+	ca, _ := writeTestCert(t, "client CA")
+	subjects := writeFile(t, `[{"Subject":"ci","Scopes":["write:/release"]}]`)
+	tests := []struct {
+		name                          string
+		key, clientCA, clientCertFile string
+		requireClientCert, auth       bool
+		ok                            bool
+	}{
+		{"cert", key, "", "", false, false, true},
+		{"no key", "", "", "", false, false, false},
+		{"client CA", key, ca, "", true, false, true},
+		{"require without CA", key, "", "", true, false, false},
+		{"subjects without CA", key, "", subjects, false, true, false},
+		// the scopes of subjects are enforced with -auth only, so they are refused without it
+		{"subjects without auth", key, ca, subjects, false, false, false},
+		{"subjects without auth, cert required", key, ca, subjects, true, false, false},
+		{"bad subjects", key, ca, writeFile(t, `[{"Subject":"ci","Scopes":["write"]}]`), false, true, false},
+		{"bad CA", key, filepath.Join(t.TempDir(), "missing"), "", false, false, false},
+		{"subjects", key, ca, subjects, false, true, true},
+	}
+	for _, tt := range tests {
+		serverTLS.cert, serverTLS.clientCAs, serverTLS.subjects = nil, nil, nil
+		svr.tlsCert, svr.tlsKey, svr.tlsClientCA, svr.clientCertFile = cert, tt.key, tt.clientCA, tt.clientCertFile
+		svr.requireClientCert, svr.auth = tt.requireClientCert, tt.auth
+		err := loadTLS()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && serverTLS.cert != nil {
+			t.Errorf("%s: loaded although it failed", tt.name)
+		}
+	}
+
+	// the subjects loaded last map a verified client certificate to its token
+	r := httptest.NewRequest("GET", "/r/download/release/a", nil)
+	if certToken(r) != nil {
+		t.Error("a token without TLS")
+	}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "ci", Organization: []string{"example"}}}}}}
+	if token := certToken(r); token == nil || !token.allows("/release/a", RIGHT_WRITE) || token.allows("/docs/a", RIGHT_READ) {
+		t.Errorf("token of the certificate: %+v", token)
+	}
+	r.TLS.VerifiedChains[0][0].Subject.CommonName = "other"
+	if certToken(r) != nil {
+		t.Error("a token of an unknown subject")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"repo/log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VERSION_DIR is the directory under dataDir which holds the replaced versions of files,
+// version n of /a/b.txt is .versions/a/b.txt/n.
+const VERSION_DIR = ".versions"
+
+// VersionsResponseInfo is the response of listing the versions of a file, newest first.
+type VersionsResponseInfo struct {
+	ErrInfo
+	Current  *FileInfo `json:",omitempty"`
+	Versions []*FileInfo
+}
+
+func versionPath(reqPath string, version int) string {
+	return path.Join(svr.dataDir, VERSION_DIR, reqPath, strconv.Itoa(version))
+}
+
+// versionPrefix is the common prefix of the keys of the versions of reqPath in the fileVersions bucket.
+func versionPrefix(reqPath string) []byte {
+	return []byte(reqPath + "\x00")
+}
+
+// versionKey sorts the versions of a file by number.
+func versionKey(reqPath string, version int) []byte {
+	return []byte(fmt.Sprintf("%s\x00%010d", reqPath, version))
+}
+
+// parseVersionLimits parses the comma separated prefix=N pairs of the -versionLimits flag.
+func parseVersionLimits(list string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || kv[0][0] != '/' {
+			return nil, fmt.Errorf("invalid version limit: %s", item)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version limit: %s", item)
+		}
+		limits[path.Clean(kv[0])] = n
+	}
+	return limits, nil
+}
+
+// versionLimit returns how many replaced versions of reqPath are kept, by the longest matching
+// prefix of -versionLimits, or -maxVersions. 0 means reqPath is not versioned.
+func versionLimit(reqPath string) int {
+	limit, matched := svr.maxVersions, -1
+	for prefix, n := range svr.versionLimits {
+		if (prefix == "/" || reqPath == prefix || strings.HasPrefix(reqPath, prefix+"/")) && len(prefix) > matched {
+			limit, matched = n, len(prefix)
+		}
+	}
+	return limit
+}
+
+// lastVersion returns the number of the newest kept version of reqPath, 0 if there is none.
+func lastVersion(tx *bolt.Tx, reqPath string) int {
+	b := tx.Bucket([]byte("fileVersions"))
+	if b == nil {
+		return 0
+	}
+	prefix := versionPrefix(reqPath)
+	c := b.Cursor()
+	// the keys of reqPath end before the next possible byte after the prefix
+	k, _ := c.Seek(append(versionPrefix(reqPath), 0xff))
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(k[len(prefix):]))
+	return n
+}
+
+// keepVersion saves old, the replaced record of reqPath, as its newest version and drops the oldest
+// versions above limit. The blob of old stays referenced by the version. It returns the dropped
+// versions, whose files should be removed once tx is committed, and the blobs which lost their last reference.
+func keepVersion(tx *bolt.Tx, snapshot dbSnapshot, reqPath string, old *FileInfo, limit int) (dropped []*FileInfo, releasedBlobs []string, err error) {
+	b := tx.Bucket([]byte("fileVersions"))
+	if b == nil {
+		return nil, nil, fmt.Errorf("read db error")
+	}
+	if old.Version == 0 {
+		// written before versioning was enabled
+		old.Version = lastVersion(tx, reqPath) + 1
+	}
+	old.DownloadPath = ""
+	encoded, err := json.Marshal(old)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := versionKey(reqPath, old.Version)
+	snapshot.save(tx, "fileVersions", string(key))
+	if err := b.Put(key, encoded); err != nil {
+		return nil, nil, err
+	}
+	prefix := versionPrefix(reqPath)
+	keys := make([][]byte, 0)
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for i := 0; i < len(keys)-limit; i++ {
+		version := &FileInfo{}
+		if err := json.Unmarshal(b.Get(keys[i]), version); err != nil {
+			return nil, nil, err
+		}
+		snapshot.save(tx, "fileVersions", string(keys[i]))
+		if version.Blob != "" {
+			snapshot.save(tx, "blobs", version.Blob)
+			last, err := releaseBlob(tx, version.Blob)
+			if err != nil {
+				return nil, nil, err
+			}
+			if last {
+				releasedBlobs = append(releasedBlobs, version.Blob)
+			}
+		}
+		if err := b.Delete(keys[i]); err != nil {
+			return nil, nil, err
+		}
+		dropped = append(dropped, version)
+	}
+	return dropped, releasedBlobs, nil
+}
+
+// getVersion reads version of reqPath from the fileVersions bucket, it returns nil if there is none.
+func getVersion(reqPath string, version int) (*FileInfo, error) {
+	var fileInfo *FileInfo
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileVersions"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		v := b.Get(versionKey(reqPath, version))
+		if v == nil {
+			return nil
+		}
+		fileInfo = &FileInfo{}
+		return json.Unmarshal(v, fileInfo)
+	})
+	return fileInfo, err
+}
+
+// getVersions reads every kept version of reqPath, newest first.
+func getVersions(reqPath string) ([]*FileInfo, error) {
+	versions := make([]*FileInfo, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileVersions"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		prefix := versionPrefix(reqPath)
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			fileInfo := &FileInfo{}
+			if err := json.Unmarshal(v, fileInfo); err != nil {
+				return err
+			}
+			versions = append([]*FileInfo{fileInfo}, versions...)
+		}
+		return nil
+	})
+	return versions, err
+}
+
+// deleteVersion removes a kept version, both its record and its file.
+func deleteVersion(tx *bolt.Tx, reqPath string, version *FileInfo) (releasedBlob string, err error) {
+	b := tx.Bucket([]byte("fileVersions"))
+	if b == nil {
+		return "", fmt.Errorf("read db error")
+	}
+	if version.Blob != "" {
+		last, err := releaseBlob(tx, version.Blob)
+		if err != nil {
+			return "", err
+		}
+		if last {
+			releasedBlob = version.Blob
+		}
+	}
+	return releasedBlob, b.Delete(versionKey(reqPath, version.Version))
+}
+
+// deleteExpiredVersions removes the versions whose own ExpiredTime has passed, a version keeps
+// the expiry it had as the current file.
+func deleteExpiredVersions() {
+	now := time.Now()
+	expired := make(map[string][]*FileInfo)
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileVersions"))
+		if b == nil {
+			log.Error("DB bucket fileVersions does not exist ")
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			version := &FileInfo{}
+			if err := json.Unmarshal(v, version); err != nil {
+				log.Errorf("%q: %v", k, err)
+				continue
+			}
+			if version.Expired(now) {
+				reqPath := string(k[:bytes.IndexByte(k, 0)])
+				expired[reqPath] = append(expired[reqPath], version)
+			}
+		}
+		return nil
+	})
+	deleteVersions(expired)
+}
+
+// getVersionsUnder reads the kept versions of reqPath, and with recursive also of every path under
+// reqPath, whether or not the path still has a current file.
+func getVersionsUnder(reqPath string, recursive bool) (map[string][]*FileInfo, error) {
+	versions := make(map[string][]*FileInfo)
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("fileVersions"))
+		if b == nil {
+			return fmt.Errorf("read db error")
+		}
+		prefixes := [][]byte{versionPrefix(reqPath)}
+		if recursive {
+			prefixes = append(prefixes, []byte(strings.TrimSuffix(reqPath, "/")+"/"))
+		}
+		for _, prefix := range prefixes {
+			c := b.Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				version := &FileInfo{}
+				if err := json.Unmarshal(v, version); err != nil {
+					log.Errorf("%q: %v", k, err)
+					continue
+				}
+				filePath := string(k[:bytes.IndexByte(k, 0)])
+				versions[filePath] = append(versions[filePath], version)
+			}
+		}
+		return nil
+	})
+	return versions, err
+}
+
+// deleteVersions removes the versions of each path, both their records and their files.
+func deleteVersions(versions map[string][]*FileInfo) {
+	for reqPath, kept := range versions {
+		blobMu.Lock()
+		releasedBlobs := make([]string, 0)
+		err := db.Update(func(tx *bolt.Tx) error {
+			for _, version := range kept {
+				releasedBlob, err := deleteVersion(tx, reqPath, version)
+				if err != nil {
+					return err
+				}
+				if releasedBlob != "" {
+					releasedBlobs = append(releasedBlobs, releasedBlob)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Error(err)
+		} else {
+			for _, version := range kept {
+				log.Debugf("remove version %d of %s", version.Version, reqPath)
+				deleteFileOnDisk(versionPath(reqPath, version.Version))
+			}
+			for _, sum := range releasedBlobs {
+				removeBlobFile(sum)
+			}
+		}
+		blobMu.Unlock()
+	}
+}
+
+/*
+List the versions of a file, kept when it is replaced if versioning is enabled with -maxVersions or -versionLimits
+curl http://localhost:50010/r/versions/jianwang/bolt.txt
+Return value:
+{"Status":0,"Msg":"OK","Current":{"CreateTime":"...","Md5":"...","Version":3,...},"Versions":[{"CreateTime":"...","Md5":"...","Version":2,
+"DownloadPath":"http://localhost:50010/r/download/jianwang/bolt.txt?version=2",...}]}
+A version is downloaded with the version parameter of download, and removed when its own ExpiredTime passes.
+The versions of a deleted or moved file are listed without Current, the ones which never expire stay until
+they are deleted with versions=true of delete.
+*/
+func listVersions(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	reqPath := ps.ByName("filepath")
+	current, err := getFileInfo(reqPath)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	versions, err := getVersions(reqPath)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	if current == nil && len(versions) == 0 {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_NOT_IN_DB))
+		return
+	}
+	if current != nil {
+		current.DownloadPath = downloadPath(r, reqPath, nil)
+	}
+	for _, version := range versions {
+		version.DownloadPath = downloadPath(r, reqPath, url.Values{"version": {strconv.Itoa(version.Version)}})
+	}
+	json.NewEncoder(w).Encode(VersionsResponseInfo{
+		ErrInfo:  MakeErrInfo(ERR_OK),
+		Current:  current,
+		Versions: versions,
+	})
+}
+
+/*
+Restore a version as the current file, the current file becomes a version itself
+curl -F version=2 "http://localhost:50010/r/restore/jianwang/bolt.txt"
+expiredTime or expiredAt is optional, the expiry of the version is kept without it
+Return value is the same as upload
+*/
+func restoreVersion(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log.Debugf("%s: %s, From: %s", r.Method, r.RequestURI, r.RemoteAddr)
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	reqPath := ps.ByName("filepath")
+	r.ParseMultipartForm(32 << 20)
+	versionNum, err := strconv.Atoi(valuesGetDefault(r.Form, "version", ""))
+	if err != nil || versionNum <= 0 {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_VERSION))
+		return
+	}
+	version, err := getVersion(reqPath, versionNum)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_READ_DB))
+		return
+	}
+	if version == nil {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_VERSION_NOT_EXIST))
+		return
+	}
+	expiredTime, expiredAt := valuesGetDefault(r.Form, "expiredTime", ""), valuesGetDefault(r.Form, "expiredAt", "")
+	if expiredTime != "" || expiredAt != "" {
+		e, err := parseExpiry(expiredTime, expiredAt, "")
+		if err != nil {
+			log.Warn(err)
+			json.NewEncoder(w).Encode(MakeErrInfo(ERR_REQ_PARAMETER_EXPIRE))
+			return
+		}
+		version.ExpiredTime = e.ExpiredTime(time.Now())
+	}
+	if st, err := os.Stat(path.Join(svr.dataDir, reqPath)); err == nil && st.IsDir() {
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_FILE_EXIST_DIR))
+		return
+	}
+	stagePath, err := stageCopy(versionPath(reqPath, versionNum), version)
+	if err != nil {
+		log.Error(err)
+		json.NewEncoder(w).Encode(MakeErrInfo(ERR_WRITE_FILE))
+		return
+	}
+	defer os.Remove(stagePath) // fails harmlessly once the staging file has been published
+	fileInfo := *version
+	fileInfo.Blob = ""
+	fileInfo.Version = 0
+	if errCode := publishFile(stagePath, reqPath, &fileInfo); errCode != ERR_OK {
+		json.NewEncoder(w).Encode(MakeErrInfo(errCode))
+		return
+	}
+	log.Infof("restore %s: version %d as version %d", reqPath, versionNum, fileInfo.Version)
+	fileInfo.DownloadPath = downloadPath(r, reqPath, nil)
+	json.NewEncoder(w).Encode(UploadResponseInfo{
+		ErrInfo: MakeErrInfo(ERR_OK),
+		File:    fileInfo,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// versionsOf lists the versions of reqPath with listVersions.
+func versionsOf(t *testing.T, reqPath string) VersionsResponseInfo {
+	t.Helper()
+	var resp VersionsResponseInfo
+	decodeJSON(t, call(listVersions, httptest.NewRequest("GET", "/r/versions"+reqPath, nil), httprouter.Param{Key: "filepath", Value: reqPath}), &resp)
+	return resp
+}
+
+// downloadVersion returns the content of version of reqPath, "" if download fails.
+func downloadVersion(reqPath, version string) string {
+	w := call(download, httptest.NewRequest("GET", "/r/download"+reqPath+"?version="+version, nil), httprouter.Param{Key: "filepath", Value: reqPath})
+	if w.Code != 200 {
+		return ""
+	}
+	return w.Body.String()
+}
+
+func TestVersioning(t *testing.T) {
+	testServer(t)
+	svr.maxVersions = 2
+	svr.versionLimits = map[string]int{"/scratch": 0}
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		storeFile(t, "/a.txt", content, nil)
+	}
+	resp := versionsOf(t, "/a.txt")
+	if resp.Status != ERR_OK || resp.Current == nil || resp.Current.Version != 4 || len(resp.Versions) != 2 {
+		t.Fatalf("versions: %+v", resp)
+	}
+	// the oldest versions are dropped at the limit, newest first
+	if resp.Versions[0].Version != 3 || resp.Versions[1].Version != 2 {
+		t.Errorf("versions %d, %d", resp.Versions[0].Version, resp.Versions[1].Version)
+	}
+	if got := downloadVersion("/a.txt", "2"); got != "v2" {
+		t.Errorf("version 2: %q", got)
+	}
+	if got := downloadVersion("/a.txt", "1"); got != "" {
+		t.Errorf("dropped version 1: %q", got)
+	}
+	if _, err := os.Stat(versionPath("/a.txt", 1)); !os.IsNotExist(err) {
+		t.Errorf("the file of the dropped version is kept: %v", err)
+	}
+
+	// a version is restored as a new version, the current file becomes a version
+	var restored UploadResponseInfo
+	decodeJSON(t, call(restoreVersion, formRequest("POST", "/r/restore/a.txt", url.Values{"version": {"2"}}), httprouter.Param{Key: "filepath", Value: "/a.txt"}), &restored)
+	if restored.Status != ERR_OK || restored.File.Version != 5 || readStored(t, "/a.txt") != "v2" {
+		t.Fatalf("restore: %+v", restored)
+	}
+	resp = versionsOf(t, "/a.txt")
+	if len(resp.Versions) != 2 || resp.Versions[0].Version != 4 || downloadVersion("/a.txt", "4") != "v4" {
+		t.Errorf("versions after restore: %+v", resp.Versions)
+	}
+	for _, tt := range []struct {
+		version string
+		want    ErrCode
+	}{
+		{"0", ERR_REQ_PARAMETER_VERSION},
+		{"x", ERR_REQ_PARAMETER_VERSION},
+		{"1", ERR_VERSION_NOT_EXIST},
+	} {
+		var resp UploadResponseInfo
+		decodeJSON(t, call(restoreVersion, formRequest("POST", "/r/restore/a.txt", url.Values{"version": {tt.version}}), httprouter.Param{Key: "filepath", Value: "/a.txt"}), &resp)
+		if resp.Status != tt.want {
+			t.Errorf("restore version %s: %+v, want %d", tt.version, resp.ErrInfo, tt.want)
+		}
+	}
+
+	// a prefix of limit 0 is not versioned
+	storeFile(t, "/scratch/b.txt", "b1", nil)
+	storeFile(t, "/scratch/b.txt", "b2", nil)
+	if resp := versionsOf(t, "/scratch/b.txt"); len(resp.Versions) != 0 {
+		t.Errorf("versions of /scratch: %+v", resp.Versions)
+	}
+}
+
+func TestVersionsOfDeletedFiles(t *testing.T) {
+	testServer(t)
+	svr.maxVersions = 5
+	storeFile(t, "/dir/a.txt", "a1", url.Values{"expiredTime": {"never"}})
+	storeFile(t, "/dir/a.txt", "a2", url.Values{"expiredTime": {"never"}})
+	storeFile(t, "/dir/b.txt", "b1", nil)
+	storeFile(t, "/dir/b.txt", "b2", nil)
+
+	// versions stay after the file is deleted or moved away, they can be restored
+	var deleted DeleteResponseInfo
+	decodeJSON(t, call(deleteFiles, httptest.NewRequest("DELETE", "/r/files/dir/a.txt", nil), httprouter.Param{Key: "filepath", Value: "/dir/a.txt"}), &deleted)
+	if deleted.Status != ERR_OK || deleted.NumDeletedVersions != 0 {
+		t.Fatalf("delete: %+v", deleted)
+	}
+	resp := versionsOf(t, "/dir/a.txt")
+	if resp.Status != ERR_OK || resp.Current != nil || len(resp.Versions) != 1 || downloadVersion("/dir/a.txt", "1") != "a1" {
+		t.Errorf("versions of a deleted file: %+v", resp)
+	}
+	if resp := transfer(t, moveFile, url.Values{"src": {"/dir/b.txt"}, "dest": {"/other/b.txt"}}); resp.Status != ERR_OK {
+		t.Fatalf("move: %+v", resp.ErrInfo)
+	}
+	if resp := versionsOf(t, "/dir/b.txt"); resp.Current != nil || len(resp.Versions) != 1 || downloadVersion("/dir/b.txt", "1") != "b1" {
+		t.Errorf("versions of a moved file: %+v", resp)
+	}
+	if resp := versionsOf(t, "/other/b.txt"); len(resp.Versions) != 0 {
+		t.Errorf("versions moved along: %+v", resp.Versions)
+	}
+	var restored UploadResponseInfo
+	decodeJSON(t, call(restoreVersion, formRequest("POST", "/r/restore/dir/a.txt", url.Values{"version": {"1"}}), httprouter.Param{Key: "filepath", Value: "/dir/a.txt"}), &restored)
+	if restored.Status != ERR_OK || readStored(t, "/dir/a.txt") != "a1" {
+		t.Fatalf("restore a deleted file: %+v", restored)
+	}
+
+	// versions=true deletes them as well, also the ones of a path without a current file
+	decodeJSON(t, call(deleteFiles, httptest.NewRequest("DELETE", "/r/files/dir?recursive=true&versions=true", nil), httprouter.Param{Key: "filepath", Value: "/dir"}), &deleted)
+	if deleted.Status != ERR_OK || deleted.NumDeletedFiles != 1 || deleted.NumDeletedVersions != 2 {
+		t.Fatalf("delete with versions: %+v", deleted)
+	}
+	for _, reqPath := range []string{"/dir/a.txt", "/dir/b.txt"} {
+		if resp := versionsOf(t, reqPath); resp.Status != ERR_FILE_NOT_IN_DB {
+			t.Errorf("%s: %+v", reqPath, resp)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(svr.dataDir, VERSION_DIR, "dir")); !os.IsNotExist(err) {
+		t.Errorf("the version files are kept: %v", err)
+	}
+	decodeJSON(t, call(deleteFiles, httptest.NewRequest("DELETE", "/r/files/dir?recursive=true&versions=true", nil), httprouter.Param{Key: "filepath", Value: "/dir"}), &deleted)
+	if deleted.Status != ERR_FILE_NOT_IN_DB {
+		t.Errorf("delete again: %+v", deleted.ErrInfo)
+	}
+	if readStored(t, "/other/b.txt") != "b2" {
+		t.Error("a file outside the deleted directory is removed")
+	}
+}